@@ -0,0 +1,438 @@
+// Package client is a Go client for the proglog server's HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	// ErrOffsetNotFound is returned when the requested offset hasn't been
+	// written yet.
+	ErrOffsetNotFound = errors.New("offset not found")
+	// ErrOffsetTruncated is returned when the requested offset has been
+	// truncated from the log.
+	ErrOffsetTruncated = errors.New("offset truncated")
+	// ErrRecordTooLarge is returned when the server refused a record for
+	// being larger than its max record size.
+	ErrRecordTooLarge = errors.New("record too large")
+)
+
+// apiKeyHeader is the header the client's API key is sent in.
+const apiKeyHeader = "Proglog-Api-Key"
+
+// Config configures a Client. Only Addr is required.
+type Config struct {
+	// Addr is the server's URL, e.g. http://localhost:8080.
+	Addr string
+	// Timeout bounds each attempt of a request. Defaults to 10s.
+	Timeout time.Duration
+	// MaxRetries is how many times a request that failed with a 5xx status or
+	// a connection error is retried. Defaults to 3; negative disables retries.
+	MaxRetries int
+	// Backoff is the wait before the first retry, doubling on each retry up
+	// to MaxBackoff. Defaults to 100ms and 5s respectively.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// PollInterval is how often a Stream that has caught up checks for new
+	// records. Defaults to 500ms.
+	PollInterval time.Duration
+	// HTTPClient sends the requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+	// Idempotent makes the client number the records it produces so that
+	// the server writes a retried produce only once. An idempotent client
+	// sends its produces one at a time.
+	Idempotent bool
+	// ReadCommitted makes Consume, ConsumeRange and streams return only
+	// records outside transactions or in committed ones.
+	ReadCommitted bool
+	// APIKey identifies the client to a server that enforces quotas.
+	APIKey string
+}
+
+// Client produces records to and consumes records from a server. It's safe
+// for concurrent use.
+type Client struct {
+	Config
+
+	// mu serializes an idempotent client's produces, so the server gets its
+	// sequence numbers in order
+	mu         sync.Mutex
+	producerID string
+	sequence   uint64
+}
+
+// New returns a client for the server at c.Addr.
+func New(c Config) (*Client, error) {
+	if c.Addr == "" {
+		return nil, errors.New("client: addr must be set")
+	}
+	c.Addr = strings.TrimSuffix(c.Addr, "/")
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 3
+	}
+	if c.Backoff == 0 {
+		c.Backoff = 100 * time.Millisecond
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 5 * time.Second
+	}
+	if c.PollInterval == 0 {
+		c.PollInterval = 500 * time.Millisecond
+	}
+	if c.HTTPClient == nil {
+		c.HTTPClient = http.DefaultClient
+	}
+	client := &Client{Config: c}
+	if c.Idempotent {
+		var err error
+		client.producerID, err = newProducerID()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// newProducerID returns a random ID for an idempotent client.
+func newProducerID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("client: generating producer ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// record is the JSON form of a record on the wire.
+type record struct {
+	Value         []byte            `json:"value"`
+	Offset        uint64            `json:"offset"`
+	Key           []byte            `json:"key,omitempty"`
+	ProduceTime   *time.Time        `json:"produce_time,omitempty"`
+	AppendTime    *time.Time        `json:"append_time,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	ProducerID    string            `json:"producer_id,omitempty"`
+	Sequence      uint64            `json:"sequence,omitempty"`
+	TransactionID string            `json:"transaction_id,omitempty"`
+}
+
+func newRecord(r *api.Record) record {
+	res := record{
+		Value:         r.Value,
+		Key:           r.Key,
+		Headers:       r.Headers,
+		ProducerID:    r.ProducerId,
+		Sequence:      r.Sequence,
+		TransactionID: r.TransactionId,
+	}
+	if r.ProduceTime != nil {
+		t := r.ProduceTime.AsTime()
+		res.ProduceTime = &t
+	}
+	return res
+}
+
+func (r record) apiRecord() *api.Record {
+	res := &api.Record{
+		Value:         r.Value,
+		Offset:        r.Offset,
+		Key:           r.Key,
+		Headers:       r.Headers,
+		ProducerId:    r.ProducerID,
+		Sequence:      r.Sequence,
+		TransactionId: r.TransactionID,
+	}
+	if r.ProduceTime != nil {
+		res.ProduceTime = timestamppb.New(*r.ProduceTime)
+	}
+	if r.AppendTime != nil {
+		res.AppendTime = timestamppb.New(*r.AppendTime)
+	}
+	return res
+}
+
+type produceResponse struct {
+	Offset uint64 `json:"offset"`
+}
+
+type rangeResponse struct {
+	Records []record `json:"records"`
+}
+
+// Produce appends the record to the log and returns its offset. The record's
+// offset and append time are set by the server and ignored here.
+//
+// A produce that's retried after the server appended the record but before
+// the response arrived writes the record again at a new offset, unless the
+// client is idempotent or the record has its own producer ID and sequence
+// number.
+func (c *Client) Produce(ctx context.Context, r *api.Record) (uint64, error) {
+	if !c.Idempotent || r.ProducerId != "" {
+		return c.produce(ctx, newRecord(r))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req := newRecord(r)
+	req.ProducerID = c.producerID
+	req.Sequence = c.sequence
+	off, err := c.produce(ctx, req)
+	if err != nil {
+		// the record may have been written, so carry on as a new producer
+		// rather than have the next record taken for a retry of this one
+		id, idErr := newProducerID()
+		if idErr != nil {
+			return 0, idErr
+		}
+		c.producerID, c.sequence = id, 0
+		return 0, err
+	}
+	c.sequence++
+	return off, nil
+}
+
+func (c *Client) produce(ctx context.Context, req record) (uint64, error) {
+	var res produceResponse
+	err := c.do(ctx, http.MethodPost, "/records", req, &res)
+	return res.Offset, err
+}
+
+// ProduceBatch appends the records in order and returns their offsets. It
+// stops at the first record that fails, returning the offsets of those
+// written before it.
+func (c *Client) ProduceBatch(ctx context.Context, records []*api.Record) ([]uint64, error) {
+	offs := make([]uint64, 0, len(records))
+	for _, r := range records {
+		off, err := c.Produce(ctx, r)
+		if err != nil {
+			return offs, err
+		}
+		offs = append(offs, off)
+	}
+	return offs, nil
+}
+
+// Begin begins a transaction with the given ID. Records produced with the
+// transaction's ID are hidden from read-committed consumers until it's
+// committed, and for good if it's aborted.
+func (c *Client) Begin(ctx context.Context, id string) error {
+	return c.endTransaction(ctx, id, "begin")
+}
+
+// Commit commits the transaction.
+func (c *Client) Commit(ctx context.Context, id string) error {
+	return c.endTransaction(ctx, id, "commit")
+}
+
+// Abort aborts the transaction.
+func (c *Client) Abort(ctx context.Context, id string) error {
+	return c.endTransaction(ctx, id, "abort")
+}
+
+func (c *Client) endTransaction(ctx context.Context, id, action string) error {
+	var res produceResponse
+	path := fmt.Sprintf("/transactions/%s/%s", url.PathEscape(id), action)
+	return c.do(ctx, http.MethodPost, path, nil, &res)
+}
+
+// Consume returns the record at off. A read-committed client gets
+// ErrOffsetNotFound for records a committed range would leave out.
+func (c *Client) Consume(ctx context.Context, off uint64) (*api.Record, error) {
+	var res record
+	path := fmt.Sprintf("/records/%d", off)
+	if c.ReadCommitted {
+		path += "?isolation=read_committed"
+	}
+	err := c.do(ctx, http.MethodGet, path, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res.apiRecord(), nil
+}
+
+// ConsumeRange returns up to max records starting at from, or none if from is
+// past the end of the log. The server may return fewer than max even if it
+// holds more.
+func (c *Client) ConsumeRange(ctx context.Context, from, max uint64) ([]*api.Record, error) {
+	var res rangeResponse
+	path := fmt.Sprintf("/records?from=%d&max=%d", from, max)
+	if c.ReadCommitted {
+		path += "&isolation=read_committed"
+	}
+	err := c.do(ctx, http.MethodGet, path, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*api.Record, len(res.Records))
+	for i, r := range res.Records {
+		records[i] = r.apiRecord()
+	}
+	return records, nil
+}
+
+// Backup copies an archive of the server's log to w, for restoring with
+// proglog restore. It isn't retried, since w may already hold part of it.
+func (c *Client) Backup(ctx context.Context, w io.Writer) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Addr+"/admin/backup", nil)
+	if err != nil {
+		return err
+	}
+	if c.APIKey != "" {
+		r.Header.Set(apiKeyHeader, c.APIKey)
+	}
+	resp, err := c.HTTPClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &statusError{code: resp.StatusCode, msg: string(bytes.TrimSpace(msg))}
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// statusError is a response the server failed with.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("client: %d %s: %s", e.code, http.StatusText(e.code), e.msg)
+}
+
+// do sends req, if any, as JSON to the path and decodes the JSON response into
+// res, retrying connection errors and 5xx responses with exponential backoff.
+func (c *Client) do(ctx context.Context, method, path string, req, res interface{}) error {
+	var b []byte
+	if req != nil {
+		var err error
+		b, err = json.Marshal(req)
+		if err != nil {
+			return err
+		}
+	}
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		err := c.attempt(ctx, method, path, b, res)
+		if !retryable(err) || attempt >= c.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > c.MaxBackoff {
+			backoff = c.MaxBackoff
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path string, body []byte, res interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, method, c.Addr+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if c.APIKey != "" {
+		r.Header.Set(apiKeyHeader, c.APIKey)
+	}
+	resp, err := c.HTTPClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return json.NewDecoder(resp.Body).Decode(res)
+	case http.StatusNotFound:
+		return ErrOffsetNotFound
+	case http.StatusGone:
+		return ErrOffsetTruncated
+	case http.StatusRequestEntityTooLarge:
+		return ErrRecordTooLarge
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return &statusError{code: resp.StatusCode, msg: string(bytes.TrimSpace(msg))}
+}
+
+// retryable reports whether the request that failed with err may succeed if
+// sent again.
+func retryable(err error) bool {
+	if err == nil || err == ErrOffsetNotFound || err == ErrOffsetTruncated ||
+		errors.Is(err, context.Canceled) {
+		return false
+	}
+	var serr *statusError
+	if errors.As(err, &serr) {
+		return serr.code >= 500
+	}
+	// anything else failed before we got a response
+	return true
+}
+
+// streamBatch is how many records a Stream asks the server for at a time.
+const streamBatch = 100
+
+// Stream reads records in order from an offset, waiting for new records once
+// it has read all there are.
+type Stream struct {
+	c       *Client
+	next    uint64
+	records []*api.Record
+}
+
+// Stream returns a stream that starts reading at from.
+func (c *Client) Stream(from uint64) *Stream {
+	return &Stream{c: c, next: from}
+}
+
+// Next returns the next record, blocking until it's appended or ctx is done.
+func (s *Stream) Next(ctx context.Context) (*api.Record, error) {
+	for len(s.records) == 0 {
+		records, err := s.c.ConsumeRange(ctx, s.next, streamBatch)
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			s.records = records
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(s.c.PollInterval):
+		}
+	}
+	r := s.records[0]
+	s.records = s.records[1:]
+	s.next = r.Offset + 1
+	return r, nil
+}
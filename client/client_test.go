@@ -0,0 +1,182 @@
+package client_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/client"
+	"github.com/andrwkng/proglog/client/clienttest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestClient(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, c *client.Client,
+	){
+		"produce and consume a record succeeds": testProduceConsume,
+		"produce batch":                         testProduceBatch,
+		"consume past end":                      testConsumePastEnd,
+		"stream follows new records":            testStream,
+		"read committed transactions":           testTransactions,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			srv, err := clienttest.NewServer()
+			require.NoError(t, err)
+			defer srv.Close()
+			c, err := client.New(client.Config{
+				Addr:         srv.URL,
+				PollInterval: 10 * time.Millisecond,
+			})
+			require.NoError(t, err)
+			fn(t, c)
+		})
+	}
+}
+
+func testProduceConsume(t *testing.T, c *client.Client) {
+	ctx := context.Background()
+	produced := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	off, err := c.Produce(ctx, &api.Record{
+		Value:       []byte("hello world"),
+		Key:         []byte("user-1"),
+		ProduceTime: timestamppb.New(produced),
+		Headers:     map[string]string{"trace-id": "abc"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	record, err := c.Consume(ctx, off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.Equal(t, off, record.Offset)
+	require.Equal(t, []byte("user-1"), record.Key)
+	require.True(t, record.ProduceTime.AsTime().Equal(produced))
+	require.NotNil(t, record.AppendTime)
+	require.Equal(t, map[string]string{"trace-id": "abc"}, record.Headers)
+}
+
+func testProduceBatch(t *testing.T, c *client.Client) {
+	offs, err := c.ProduceBatch(context.Background(), []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, offs)
+}
+
+func testConsumePastEnd(t *testing.T, c *client.Client) {
+	_, err := c.Consume(context.Background(), 1)
+	require.Equal(t, client.ErrOffsetNotFound, err)
+}
+
+func testStream(t *testing.T, c *client.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s := c.Stream(0)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = c.Produce(ctx, &api.Record{Value: []byte("late")})
+	}()
+	record, err := s.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("late"), record.Value)
+
+	ctx, cancel = context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = s.Next(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func testTransactions(t *testing.T, c *client.Client) {
+	ctx := context.Background()
+	config := c.Config
+	config.ReadCommitted = true
+	committed, err := client.New(config)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Begin(ctx, "t1"))
+	_, err = c.Produce(ctx, &api.Record{Value: []byte("pending"), TransactionId: "t1"})
+	require.NoError(t, err)
+	records, err := committed.ConsumeRange(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	records, err = c.ConsumeRange(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	require.NoError(t, c.Commit(ctx, "t1"))
+	records, err = committed.ConsumeRange(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "t1", records[0].TransactionId)
+	require.Error(t, c.Abort(ctx, "t1"))
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"offset":7}`))
+	}))
+	defer srv.Close()
+
+	c, err := client.New(client.Config{Addr: srv.URL, Backoff: time.Millisecond})
+	require.NoError(t, err)
+	off, err := c.Produce(context.Background(), &api.Record{Value: []byte("retried")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	require.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	c, err = client.New(client.Config{Addr: srv.URL, MaxRetries: -1})
+	require.NoError(t, err)
+	atomic.StoreInt32(&calls, 0)
+	_, err = c.Produce(context.Background(), &api.Record{Value: []byte("not retried")})
+	require.Error(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestIdempotentClient(t *testing.T) {
+	backend, err := clienttest.NewServer()
+	require.NoError(t, err)
+	defer backend.Close()
+	target, err := url.Parse(backend.URL)
+	require.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	// lose the response to the first produce after the server has appended
+	// the record, so the client retries it
+	var produces int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && atomic.AddInt32(&produces, 1) == 1 {
+			proxy.ServeHTTP(httptest.NewRecorder(), r)
+			http.Error(w, "response lost", http.StatusBadGateway)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c, err := client.New(client.Config{Addr: srv.URL, Backoff: time.Millisecond, Idempotent: true})
+	require.NoError(t, err)
+	for i := uint64(0); i < 2; i++ {
+		off, err := c.Produce(ctx, &api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&produces))
+
+	_, err = c.Consume(ctx, 2)
+	require.Equal(t, client.ErrOffsetNotFound, err)
+}
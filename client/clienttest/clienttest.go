@@ -0,0 +1,58 @@
+// Package clienttest runs a proglog server in process for testing code that
+// uses the client package.
+package clienttest
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/andrwkng/proglog/internal/log"
+	"github.com/andrwkng/proglog/internal/server"
+)
+
+// Server is a server backed by a log in a temporary directory, which it also
+// writes its snapshots under.
+type Server struct {
+	// URL is the server's base URL, to use as the client's Addr.
+	URL string
+
+	srv *httptest.Server
+	log *log.Log
+	dir string
+}
+
+// NewServer starts a server with an empty log. Callers should Close it when
+// done.
+func NewServer() (*Server, error) {
+	dir, err := ioutil.TempDir("", "proglog-clienttest")
+	if err != nil {
+		return nil, err
+	}
+	err = os.Mkdir(filepath.Join(dir, "log"), 0755)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	l, err := log.NewLog(filepath.Join(dir, "log"), log.Config{})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	srv := httptest.NewServer(server.NewHTTPServer("", &server.Config{
+		CommitLog:   l,
+		SnapshotDir: filepath.Join(dir, "snapshots"),
+	}).Handler)
+	return &Server{URL: srv.URL, srv: srv, log: l, dir: dir}, nil
+}
+
+// Close shuts the server down and removes its log.
+func (s *Server) Close() error {
+	s.srv.Close()
+	err := s.log.Close()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(s.dir)
+}
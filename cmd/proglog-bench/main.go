@@ -0,0 +1,318 @@
+// Command proglog-bench generates load against an embedded log or a running
+// server and reports throughput and latency percentiles, to compare segment
+// and durability settings.
+//
+// Usage:
+//
+//	proglog-bench [-addr URL] [-duration D] [-concurrency N] [-record-size B]
+//	              [-batch N] [-read-ratio R] [-prefill N] [log flags]
+//
+// Without -addr it opens a log in a temporary directory (or -dir) configured
+// by the -segment-* and -sync-on-append flags.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/client"
+	"github.com/andrwkng/proglog/internal/log"
+)
+
+func main() {
+	addr := flag.String("addr", "", "server URL to benchmark instead of an embedded log")
+	dir := flag.String("dir", "", "directory for the embedded log (default a new temporary directory)")
+	duration := flag.Duration("duration", 10*time.Second, "how long to run")
+	concurrency := flag.Int("concurrency", 4, "number of concurrent workers")
+	recordSize := flag.Int("record-size", 100, "bytes in each record's value")
+	batch := flag.Int("batch", 1, "records appended per write operation")
+	readRatio := flag.Float64("read-ratio", 0, "fraction of operations that are reads, from 0 to 1")
+	prefill := flag.Int("prefill", 1000, "records to append before starting, if reading")
+	var lc log.Config
+	flag.Uint64Var(&lc.Segment.MaxStoreBytes, "segment-max-store-bytes", 1<<20, "embedded log's max store bytes")
+	flag.Uint64Var(&lc.Segment.MaxIndexBytes, "segment-max-index-bytes", 1<<20, "embedded log's max index bytes")
+	flag.BoolVar(&lc.Durability.SyncOnAppend, "sync-on-append", false, "embedded log fsyncs after every append")
+	flag.Parse()
+
+	if *readRatio < 0 || *readRatio > 1 || *concurrency < 1 || *batch < 1 || *recordSize < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	t, cleanup, err := newTarget(*addr, *dir, lc)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "proglog-bench:", err)
+		os.Exit(1)
+	}
+	b := &bench{
+		target:     t,
+		recordSize: *recordSize,
+		batch:      *batch,
+		readRatio:  *readRatio,
+	}
+	if *readRatio > 0 {
+		err = b.prefill(*prefill)
+	}
+	if err == nil {
+		err = b.run(*duration, *concurrency)
+	}
+	if cerr := cleanup(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "proglog-bench:", err)
+		os.Exit(1)
+	}
+	b.report(os.Stdout)
+}
+
+// target is what the benchmark appends records to and reads them from.
+type target interface {
+	append(ctx context.Context, records []*api.Record) (last uint64, err error)
+	read(ctx context.Context, off uint64) error
+}
+
+// newTarget returns the server at addr, or an embedded log if addr is empty,
+// and a function that releases it.
+func newTarget(addr, dir string, lc log.Config) (target, func() error, error) {
+	if addr != "" {
+		c, err := client.New(client.Config{Addr: addr, MaxRetries: -1})
+		if err != nil {
+			return nil, nil, err
+		}
+		return &serverTarget{c}, func() error { return nil }, nil
+	}
+
+	remove := dir == ""
+	if remove {
+		var err error
+		dir, err = ioutil.TempDir("", "proglog-bench")
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	l, err := log.NewLog(dir, lc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &logTarget{l}, func() error {
+		err := l.Close()
+		if remove {
+			os.RemoveAll(dir)
+		}
+		return err
+	}, nil
+}
+
+type logTarget struct {
+	log *log.Log
+}
+
+func (t *logTarget) append(_ context.Context, records []*api.Record) (uint64, error) {
+	var off uint64
+	for _, r := range records {
+		var err error
+		off, err = t.log.Append(r)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return off, nil
+}
+
+func (t *logTarget) read(_ context.Context, off uint64) error {
+	_, err := t.log.Read(off)
+	return err
+}
+
+type serverTarget struct {
+	client *client.Client
+}
+
+func (t *serverTarget) append(ctx context.Context, records []*api.Record) (uint64, error) {
+	offs, err := t.client.ProduceBatch(ctx, records)
+	if err != nil {
+		return 0, err
+	}
+	return offs[len(offs)-1], nil
+}
+
+func (t *serverTarget) read(ctx context.Context, off uint64) error {
+	_, err := t.client.Consume(ctx, off)
+	return err
+}
+
+// bench runs the workers and collects their measurements.
+type bench struct {
+	target     target
+	recordSize int
+	batch      int
+	readRatio  float64
+
+	// low and high bound the offsets the benchmark has written, which reads
+	// pick from, once written is set. They're updated together under
+	// rangeMu so a reader never sees a high below low.
+	rangeMu   sync.Mutex
+	low, high uint64
+	written   bool
+
+	mu       sync.Mutex
+	elapsed  time.Duration
+	writes   []time.Duration
+	reads    []time.Duration
+	errors   int
+	firstErr error
+}
+
+func (b *bench) records() []*api.Record {
+	value := make([]byte, b.recordSize)
+	_, _ = rand.Read(value)
+	records := make([]*api.Record, b.batch)
+	for i := range records {
+		records[i] = &api.Record{Value: value}
+	}
+	return records
+}
+
+// wrote records that offsets up to off exist.
+func (b *bench) wrote(off uint64) {
+	b.rangeMu.Lock()
+	defer b.rangeMu.Unlock()
+	if !b.written {
+		b.low, b.high, b.written = off, off, true
+	}
+	if off > b.high {
+		b.high = off
+	}
+}
+
+// readRange returns the offsets reads pick from, and false if nothing's been
+// written yet.
+func (b *bench) readRange() (low, high uint64, ok bool) {
+	b.rangeMu.Lock()
+	defer b.rangeMu.Unlock()
+	return b.low, b.high, b.written
+}
+
+func (b *bench) prefill(n int) error {
+	ctx := context.Background()
+	for i := 0; i < n; i += b.batch {
+		off, err := b.target.append(ctx, b.records())
+		if err != nil {
+			return err
+		}
+		b.wrote(off)
+	}
+	return nil
+}
+
+func (b *bench) run(duration time.Duration, concurrency int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			b.work(ctx, mrand.New(mrand.NewSource(seed)))
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	b.elapsed = time.Since(start)
+	if len(b.writes)+len(b.reads) == 0 && b.firstErr != nil {
+		return b.firstErr
+	}
+	return nil
+}
+
+// work runs operations until ctx is done, timing each.
+func (b *bench) work(ctx context.Context, rnd *mrand.Rand) {
+	records := b.records()
+	var writes, reads []time.Duration
+	var errors int
+	var firstErr error
+	for ctx.Err() == nil {
+		low, high, written := b.readRange()
+		read := written && rnd.Float64() < b.readRatio
+		start := time.Now()
+		var err error
+		if read {
+			err = b.target.read(ctx, low+uint64(rnd.Int63n(int64(high-low+1))))
+		} else {
+			var off uint64
+			off, err = b.target.append(ctx, records)
+			if err == nil {
+				b.wrote(off)
+			}
+		}
+		took := time.Since(start)
+		if err != nil {
+			if ctx.Err() == nil {
+				errors++
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+			continue
+		}
+		if read {
+			reads = append(reads, took)
+		} else {
+			writes = append(writes, took)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.writes = append(b.writes, writes...)
+	b.reads = append(b.reads, reads...)
+	b.errors += errors
+	if b.firstErr == nil {
+		b.firstErr = firstErr
+	}
+}
+
+func (b *bench) report(w io.Writer) {
+	secs := b.elapsed.Seconds()
+	records := len(b.writes) * b.batch
+	fmt.Fprintf(w, "%-15s%s\n", "duration:", b.elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "%-15s%d ops (%.0f ops/s), %d records (%.0f records/s, %.2f MB/s)\n", "writes:",
+		len(b.writes), float64(len(b.writes))/secs,
+		records, float64(records)/secs, float64(records*b.recordSize)/secs/1e6)
+	fmt.Fprintf(w, "%-15s%d ops (%.0f ops/s)\n", "reads:", len(b.reads), float64(len(b.reads))/secs)
+	fmt.Fprintf(w, "%-15s%d\n", "errors:", b.errors)
+	if b.firstErr != nil {
+		fmt.Fprintf(w, "%-15s%v\n", "first error:", b.firstErr)
+	}
+	printLatencies(w, "write latency", b.writes)
+	printLatencies(w, "read latency", b.reads)
+}
+
+func printLatencies(w io.Writer, name string, ds []time.Duration) {
+	if len(ds) == 0 {
+		return
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	fmt.Fprintf(w, "%-15sp50 %s  p90 %s  p99 %s  p99.9 %s  max %s\n", name+":",
+		percentile(ds, 50), percentile(ds, 90), percentile(ds, 99), percentile(ds, 99.9), ds[len(ds)-1])
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)) * p / 100)
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
@@ -0,0 +1,102 @@
+// Command proglog-fsck checks a log directory's segments and optionally
+// repairs them. The log must not be open in a server while it runs.
+//
+// Usage:
+//
+//	proglog-fsck -dir DIR [-keyring FILE] [-rebuild-index] [-truncate] [-quarantine] [-json]
+//
+// Like fsck, it exits 0 if the log is clean, 1 if every issue found was
+// repaired, 4 if some weren't and 8 if it couldn't check the log.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/andrwkng/proglog/internal/log"
+)
+
+const (
+	exitClean      = 0
+	exitRepaired   = 1
+	exitUnrepaired = 4
+	exitError      = 8
+)
+
+func main() {
+	dir := flag.String("dir", ".", "log directory to check")
+	rebuild := flag.Bool("rebuild-index", false, "rebuild indexes that don't match their store")
+	truncate := flag.Bool("truncate", false, "truncate torn or corrupt tails off stores and indexes")
+	quarantine := flag.Bool("quarantine", false, "move unrecoverable segments into the quarantine subdirectory")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	keyring := flag.String("keyring", "", "keyring file to decrypt an encrypted log's frames with")
+	flag.Parse()
+
+	var keys *log.Keyring
+	if *keyring != "" {
+		var err error
+		keys, err = log.OpenKeyring(*keyring)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "proglog-fsck:", err)
+			os.Exit(exitError)
+		}
+	}
+
+	report, err := log.Check(*dir, log.CheckOptions{
+		RebuildIndexes: *rebuild,
+		TruncateTails:  *truncate,
+		Quarantine:     *quarantine,
+		Keyring:        keys,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "proglog-fsck:", err)
+		os.Exit(exitError)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = printReport(report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "proglog-fsck:", err)
+		os.Exit(exitError)
+	}
+
+	switch {
+	case report.Clean():
+		os.Exit(exitClean)
+	case report.Unrepaired() == 0:
+		os.Exit(exitRepaired)
+	default:
+		os.Exit(exitUnrepaired)
+	}
+}
+
+func printReport(r *log.Report) error {
+	for _, s := range r.Segments {
+		status := "ok"
+		if s.Quarantined {
+			status = "quarantined"
+		}
+		fmt.Printf("segment %d: next offset %d, %d frames, %d/%d store bytes valid, %d index entries: %s\n",
+			s.BaseOffset, s.NextOffset, s.Frames, s.ValidStoreBytes, s.StoreBytes, s.IndexEntries, status)
+		if len(s.Actions) > 0 {
+			fmt.Printf("  %s\n", strings.Join(s.Actions, ", "))
+		}
+	}
+	for _, i := range r.Issues {
+		state := "NOT REPAIRED"
+		if i.Repaired {
+			state = "repaired"
+		}
+		fmt.Printf("segment %d: %s: %s (%s)\n", i.Segment, i.Kind, i.Detail, state)
+	}
+	_, err := fmt.Printf("%d issues, %d not repaired\n", len(r.Issues), r.Unrepaired())
+	return err
+}
@@ -0,0 +1,142 @@
+// Command proglog-inspect reads a log directory's segment files without
+// modifying them, to debug a log without hex-dumping its files.
+//
+// Usage:
+//
+//	proglog-inspect -dir DIR segments
+//	proglog-inspect -dir DIR [-keyring FILE] dump [-from OFFSET] [-to OFFSET]
+//	proglog-inspect -dir DIR index -segment BASE_OFFSET
+//	proglog-inspect -dir DIR [-keyring FILE] verify
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/internal/log"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func main() {
+	dir := flag.String("dir", ".", "log directory to inspect")
+	keyring := flag.String("keyring", "", "keyring file to decrypt an encrypted log's records with")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var keys *log.Keyring
+	var err error
+	if *keyring != "" {
+		keys, err = log.OpenKeyring(*keyring)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "proglog-inspect:", err)
+			os.Exit(1)
+		}
+	}
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "segments":
+		err = segments(*dir)
+	case "dump":
+		err = dump(*dir, keys, args)
+	case "index":
+		err = index(*dir, args)
+	case "verify":
+		err = verify(*dir, keys)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "proglog-inspect:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `usage: proglog-inspect [-dir DIR] <command> [args]
+
+commands:
+  segments                  list segments with their offsets and sizes
+  dump [-from N] [-to N]    print the records in the offset range as JSON
+  index -segment BASE       print the raw entries of a segment's index
+  verify                    check every index entry points at a valid record
+
+`)
+	flag.PrintDefaults()
+}
+
+// segments lists each segment's base and next offsets and file sizes.
+func segments(dir string) error {
+	segments, err := log.InspectDir(dir)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BASE\tNEXT\tRECORDS\tSTORE BYTES\tINDEX BYTES")
+	for _, s := range segments {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%d\n",
+			s.BaseOffset, s.NextOffset, s.Entries, s.StoreBytes, s.IndexBytes)
+	}
+	return w.Flush()
+}
+
+// dump prints the records in the requested range, one JSON object per line.
+func dump(dir string, keys *log.Keyring, args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	from := fs.Uint64("from", 0, "first offset to print")
+	to := fs.Uint64("to", math.MaxUint64, "last offset to print")
+	fs.Parse(args)
+
+	return log.ReadRecords(dir, keys, *from, *to, func(record *api.Record) error {
+		b, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("%s\n", b)
+		return err
+	})
+}
+
+// index prints every entry in a segment's index file, including the zeroed
+// entries of an index that wasn't truncated on close.
+func index(dir string, args []string) error {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	base := fs.Uint64("segment", 0, "base offset of the segment")
+	fs.Parse(args)
+
+	s := log.SegmentInfo{Dir: dir, BaseOffset: *base}
+	entries, err := log.ReadIndexEntries(s.IndexPath())
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTRY\tRELATIVE OFFSET\tOFFSET\tPOSITION")
+	for i, e := range entries {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\n", i, e.Offset, s.BaseOffset+uint64(e.Offset), e.Pos)
+	}
+	return w.Flush()
+}
+
+// verify prints any problems found and fails if there are any.
+func verify(dir string, keys *log.Keyring) error {
+	problems, err := log.Verify(dir, keys)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found", len(problems))
+	}
+	fmt.Println("ok")
+	return nil
+}
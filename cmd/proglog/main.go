@@ -0,0 +1,255 @@
+// Command proglog produces records to and consumes records from a proglog
+// server.
+//
+// Usage:
+//
+//	proglog [-addr URL] produce [FILE...]
+//	proglog [-addr URL] consume [-from OFFSET] [-to OFFSET] [-f] [-format raw|json|text]
+//	proglog [-addr URL] backup [-o FILE]
+//	proglog restore -dir DIR [-i FILE]
+//
+// produce appends each line of the files, or of stdin if none are given, as a
+// record and prints its offset. consume prints the records from -from up to
+// -to or the end of the log; with -f it keeps polling for new records like
+// tail -f. backup saves an archive of the server's log, which restore extracts
+// into an empty directory for a server to be started on.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/client"
+	"github.com/andrwkng/proglog/internal/log"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+)
+
+func main() {
+	addr := flag.String("addr", "http://localhost:8080", "server URL")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	// produces are sent one at a time anyway, so have retries written once
+	c, err := client.New(client.Config{Addr: *addr, Idempotent: true})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "proglog:", err)
+		os.Exit(1)
+	}
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "produce":
+		err = produce(c, args)
+	case "consume":
+		err = consume(c, args)
+	case "backup":
+		err = backup(c, args)
+	case "restore":
+		err = restore(args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "proglog:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `usage: proglog [-addr URL] <command> [args]
+
+commands:
+  produce [FILE...]                 append each line of the files or stdin
+  consume [-from N] [-to N] [-f]    print records, following new ones with -f
+          [-format raw|json|text]
+  backup [-o FILE]                  save an archive of the log to FILE or stdout
+  restore -dir DIR [-i FILE]        extract an archive from FILE or stdin into DIR
+
+`)
+	flag.PrintDefaults()
+}
+
+// produce appends every line read from the named files, or stdin, and prints
+// the offset each was written at.
+func produce(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("produce", flag.ExitOnError)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		return produceLines(c, os.Stdin)
+	}
+	for _, name := range fs.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = produceLines(c, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func produceLines(c *client.Client, r io.Reader) error {
+	ctx := context.Background()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		off, err := c.Produce(ctx, &api.Record{Value: scanner.Bytes()})
+		if err != nil {
+			return err
+		}
+		fmt.Println(off)
+	}
+	return scanner.Err()
+}
+
+// consume prints the records in the requested range in the requested format.
+func consume(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("consume", flag.ExitOnError)
+	from := fs.Uint64("from", 0, "first offset to print")
+	to := fs.Uint64("to", math.MaxUint64, "last offset to print")
+	follow := fs.Bool("f", false, "wait for and print new records as they're appended")
+	poll := fs.Duration("poll", 500*time.Millisecond, "how often to check for new records with -f")
+	format := fs.String("format", "raw", "output format: raw, json or text")
+	fs.Parse(args)
+
+	write, err := printer(*format)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	ctx := context.Background()
+	if *follow {
+		c.PollInterval = *poll
+		s := c.Stream(*from)
+		for {
+			// flush what we've printed in case Next has to wait for more
+			err = w.Flush()
+			if err != nil {
+				return err
+			}
+			record, err := s.Next(ctx)
+			if err != nil {
+				return err
+			}
+			if record.Offset > *to {
+				return nil
+			}
+			err = write(w, record)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for off := *from; off <= *to; off++ {
+		record, err := c.Consume(ctx, off)
+		if err == client.ErrOffsetNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = write(w, record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backup writes an archive of the server's log to the -o file or stdout.
+func backup(c *client.Client, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("o", "", "file to write the archive to instead of stdout")
+	fs.Parse(args)
+
+	if *out == "" {
+		return c.Backup(context.Background(), os.Stdout)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	err = c.Backup(context.Background(), f)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
+
+// restore extracts an archive from the -i file or stdin into an empty
+// directory, without involving the server.
+func restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("dir", "", "empty directory to restore the log into")
+	in := fs.String("i", "", "file to read the archive from instead of stdin")
+	fs.Parse(args)
+
+	if *dir == "" {
+		return errors.New("restore: -dir is required")
+	}
+	r := os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	m, err := log.Restore(r, *dir)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %d segments with offsets %d to %d\n",
+		len(m.Segments), m.LowestOffset, m.NextOffset)
+	return nil
+}
+
+// printer returns the function that writes records in the given format.
+func printer(format string) (func(io.Writer, *api.Record) error, error) {
+	switch format {
+	case "raw":
+		return func(w io.Writer, record *api.Record) error {
+			_, err := fmt.Fprintf(w, "%s\n", record.Value)
+			return err
+		}, nil
+	case "json":
+		return func(w io.Writer, record *api.Record) error {
+			b, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(record)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "%s\n", b)
+			return err
+		}, nil
+	case "text":
+		return func(w io.Writer, record *api.Record) error {
+			b, err := prototext.MarshalOptions{EmitUnknown: true}.Marshal(record)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "%s\n", b)
+			return err
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
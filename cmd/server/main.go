@@ -1,12 +1,131 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/andrwkng/proglog/internal/config"
+	commitlog "github.com/andrwkng/proglog/internal/log"
+	"github.com/andrwkng/proglog/internal/schema"
 	"github.com/andrwkng/proglog/internal/server"
 )
 
+// shutdownTimeout bounds how long in-flight requests may take to drain.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	s := server.NewHTTPServer(":8080")
-	log.Fatal(s.ListenAndServe())
+	c, err := config.Load(os.Args[0], os.Args[1:], os.Getenv)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.MkdirAll(c.DataDir, 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
+	lc := c.LogConfig()
+	if c.Encryption.Keyring != "" {
+		lc.Encryption.Keyring, err = openKeyring(c.Encryption.Keyring)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if c.Tiering.Dir != "" {
+		lc.Tiering.Blobs, err = commitlog.NewDirBlobStore(c.Tiering.Dir)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	clog, err := commitlog.NewLog(c.DataDir, lc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stop := make(chan struct{})
+	if lc.Encryption.Keyring != nil && c.Encryption.ReencryptInterval > 0 {
+		go every(c.Encryption.ReencryptInterval, stop, "re-encrypted", clog.Reencrypt)
+	}
+	if lc.Tiering.Blobs != nil {
+		go every(c.Tiering.Interval, stop, "offloaded", clog.Offload)
+	}
+	schemas, err := schema.NewRegistry(c.SchemaDir, c.SchemaConfig())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := server.NewHTTPServer(c.Addr, &server.Config{
+		CommitLog:      clog,
+		SnapshotDir:    c.SnapshotDir,
+		Schemas:        schemas,
+		Quotas:         c.QuotaConfig(),
+		MaxRecordBytes: c.Segment.MaxRecordBytes,
+		AllowedOrigins: c.AllowedOrigins,
+	})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.ListenAndServe()
+	}()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err = <-errc:
+		log.Print(err)
+	case sig := <-sigc:
+		log.Printf("received %s, shutting down", sig)
+		// stop accepting connections and wait for in-flight requests to finish
+		// before closing the log, so every acknowledged append gets flushed
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err = s.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	close(stop)
+	// flush store buffers and sync and truncate the index files
+	if err := clog.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := schemas.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		os.Exit(1)
+	}
+}
+
+// openKeyring opens the keyring at path, creating it if it doesn't exist.
+func openKeyring(path string) (*commitlog.Keyring, error) {
+	keys, err := commitlog.OpenKeyring(path)
+	if os.IsNotExist(err) {
+		log.Printf("creating keyring %s", path)
+		return commitlog.CreateKeyring(path)
+	}
+	return keys, err
+}
+
+// every calls fn, which re-encrypts or offloads segments, every interval
+// until stop is closed, logging what it did.
+func every(interval time.Duration, stop <-chan struct{}, did string, fn func() (int, error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		n, err := fn()
+		if n > 0 {
+			log.Printf("%s %d segments", did, n)
+		}
+		if err != nil {
+			log.Printf("%s %d segments before failing: %v", did, n, err)
+		}
+	}
 }
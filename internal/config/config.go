@@ -0,0 +1,390 @@
+// Package config loads the server's configuration.
+//
+// Settings are read from, in increasing order of precedence: built-in
+// defaults, a YAML or JSON file named by the -config flag or the
+// PROGLOG_CONFIG environment variable, PROGLOG_* environment variables, and
+// command-line flags. So a flag always wins over the environment, which wins
+// over the file.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/andrwkng/proglog/internal/log"
+	"github.com/andrwkng/proglog/internal/schema"
+	"github.com/andrwkng/proglog/internal/server"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds everything cmd/server needs to start.
+type Config struct {
+	Addr    string `yaml:"addr"`
+	DataDir string `yaml:"data_dir"`
+	// SnapshotDir defaults to the data dir with a -snapshots suffix, which is
+	// likely on the same file system so snapshots can hard-link segments.
+	SnapshotDir string `yaml:"snapshot_dir"`
+	// SchemaDir holds the schema registry's log and defaults to the data dir
+	// with a -schemas suffix.
+	SchemaDir string `yaml:"schema_dir"`
+	// SchemaCompatibility is the check new schema versions must pass,
+	// BACKWARD or NONE.
+	SchemaCompatibility string `yaml:"schema_compatibility"`
+	// AllowedOrigins are the origins of other sites' pages, like dashboards,
+	// that may stream records over a WebSocket. Only the config file can set
+	// it.
+	AllowedOrigins []string `yaml:"allowed_origins"`
+	Segment        struct {
+		MaxStoreBytes uint64 `yaml:"max_store_bytes"`
+		MaxIndexBytes uint64 `yaml:"max_index_bytes"`
+		InitialOffset uint64 `yaml:"initial_offset"`
+		// MaxRecordBytes is the largest record appends accept. It can't be
+		// more than MaxStoreBytes, which it defaults to.
+		MaxRecordBytes uint64 `yaml:"max_record_bytes"`
+	} `yaml:"segment"`
+	Durability struct {
+		SyncOnAppend bool `yaml:"sync_on_append"`
+		// MaxBatch turns on group commit when it's more than one.
+		MaxBatch  int           `yaml:"max_batch"`
+		MaxLinger time.Duration `yaml:"max_linger"`
+	} `yaml:"durability"`
+	Retention struct {
+		MaxBytes uint64        `yaml:"max_bytes"`
+		MaxAge   time.Duration `yaml:"max_age"`
+	} `yaml:"retention"`
+	Encryption struct {
+		// Keyring is the keyring file segments are encrypted with, created
+		// if it doesn't exist. Encryption is disabled if it's empty.
+		Keyring string `yaml:"keyring"`
+		// ReencryptInterval is how often segments encrypted with old keys
+		// are re-encrypted with the active key. Zero disables it.
+		ReencryptInterval time.Duration `yaml:"reencrypt_interval"`
+	} `yaml:"encryption"`
+	Tiering struct {
+		// Dir is the directory sealed segments are uploaded to. Tiered
+		// storage is disabled if it's empty.
+		Dir string `yaml:"dir"`
+		// Interval is how often sealed segments are uploaded.
+		Interval time.Duration `yaml:"interval"`
+		// LocalAge is how long uploaded segments are kept on local disk. Zero
+		// keeps them.
+		LocalAge time.Duration `yaml:"local_age"`
+		// CacheSegments caps how many segments fetched back are cached.
+		CacheSegments int `yaml:"cache_segments"`
+	} `yaml:"tiering"`
+	Transactions struct {
+		// Timeout is how long a transaction can be open before it's aborted.
+		Timeout time.Duration `yaml:"timeout"`
+	} `yaml:"transactions"`
+	Quotas struct {
+		// APIKeys maps the API keys clients send to their names. Only the
+		// config file can set it.
+		APIKeys map[string]string `yaml:"api_keys"`
+		// Default is the quota of clients not in Clients. Zero rates are
+		// unlimited.
+		Default Quota `yaml:"default"`
+		// Clients holds particular clients' quotas, by API key name or
+		// certificate common name. Only the config file can set it.
+		Clients map[string]Quota `yaml:"clients"`
+	} `yaml:"quotas"`
+}
+
+// Quota is a client's produce and consume rates.
+type Quota struct {
+	ProduceBytesPerSecond    float64 `yaml:"produce_bytes_per_second"`
+	ProduceRequestsPerSecond float64 `yaml:"produce_requests_per_second"`
+	ConsumeBytesPerSecond    float64 `yaml:"consume_bytes_per_second"`
+	ConsumeRequestsPerSecond float64 `yaml:"consume_requests_per_second"`
+}
+
+// Default returns the configuration used when nothing else is set.
+func Default() *Config {
+	c := &Config{
+		Addr:                ":8080",
+		DataDir:             filepath.Join(os.TempDir(), "proglog"),
+		SchemaCompatibility: string(schema.Backward),
+	}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Encryption.ReencryptInterval = time.Hour
+	c.Tiering.Interval = time.Minute
+	c.Tiering.CacheSegments = 4
+	c.Transactions.Timeout = time.Minute
+	return c
+}
+
+// setting ties a config field to its flag and environment variable.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	value flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"addr", "PROGLOG_ADDR", "address to listen on", (*stringValue)(&c.Addr)},
+		{"data-dir", "PROGLOG_DATA_DIR", "directory the log's segments are stored in", (*stringValue)(&c.DataDir)},
+		{"snapshot-dir", "PROGLOG_SNAPSHOT_DIR", "directory snapshots are written into (default data dir + \"-snapshots\")", (*stringValue)(&c.SnapshotDir)},
+		{"schema-dir", "PROGLOG_SCHEMA_DIR", "directory the schema registry is stored in (default data dir + \"-schemas\")", (*stringValue)(&c.SchemaDir)},
+		{"schema-compatibility", "PROGLOG_SCHEMA_COMPATIBILITY", "check new schema versions must pass: BACKWARD or NONE", (*stringValue)(&c.SchemaCompatibility)},
+		{"segment-max-store-bytes", "PROGLOG_SEGMENT_MAX_STORE_BYTES", "store size at which a new segment is rolled", (*uint64Value)(&c.Segment.MaxStoreBytes)},
+		{"segment-max-index-bytes", "PROGLOG_SEGMENT_MAX_INDEX_BYTES", "index size at which a new segment is rolled", (*uint64Value)(&c.Segment.MaxIndexBytes)},
+		{"segment-initial-offset", "PROGLOG_SEGMENT_INITIAL_OFFSET", "offset of the first record in a new log", (*uint64Value)(&c.Segment.InitialOffset)},
+		{"segment-max-record-bytes", "PROGLOG_SEGMENT_MAX_RECORD_BYTES", "size of the largest record appends accept (default segment max store bytes)", (*uint64Value)(&c.Segment.MaxRecordBytes)},
+		{"sync-on-append", "PROGLOG_SYNC_ON_APPEND", "fsync the active segment after every append", (*boolValue)(&c.Durability.SyncOnAppend)},
+		{"group-commit-max-batch", "PROGLOG_GROUP_COMMIT_MAX_BATCH", "most concurrent appends written and synced together (1 or less disables group commit)", (*intValue)(&c.Durability.MaxBatch)},
+		{"group-commit-max-linger", "PROGLOG_GROUP_COMMIT_MAX_LINGER", "how long a group commit waits for more appends", (*durationValue)(&c.Durability.MaxLinger)},
+		{"retention-max-bytes", "PROGLOG_RETENTION_MAX_BYTES", "total store size after which the oldest segments are removed (0 keeps everything)", (*uint64Value)(&c.Retention.MaxBytes)},
+		{"retention-max-age", "PROGLOG_RETENTION_MAX_AGE", "age after which segments are removed (0 keeps everything)", (*durationValue)(&c.Retention.MaxAge)},
+		{"encryption-keyring", "PROGLOG_ENCRYPTION_KEYRING", "keyring file to encrypt segments with, created if missing (empty disables encryption)", (*stringValue)(&c.Encryption.Keyring)},
+		{"encryption-reencrypt-interval", "PROGLOG_ENCRYPTION_REENCRYPT_INTERVAL", "how often segments encrypted with old keys are re-encrypted (0 disables it)", (*durationValue)(&c.Encryption.ReencryptInterval)},
+		{"tiering-dir", "PROGLOG_TIERING_DIR", "directory sealed segments are uploaded to (empty disables tiered storage)", (*stringValue)(&c.Tiering.Dir)},
+		{"tiering-interval", "PROGLOG_TIERING_INTERVAL", "how often sealed segments are uploaded", (*durationValue)(&c.Tiering.Interval)},
+		{"tiering-local-age", "PROGLOG_TIERING_LOCAL_AGE", "age after which uploaded segments are removed from local disk (0 keeps them)", (*durationValue)(&c.Tiering.LocalAge)},
+		{"tiering-cache-segments", "PROGLOG_TIERING_CACHE_SEGMENTS", "how many segments fetched from the tiering dir are cached locally", (*intValue)(&c.Tiering.CacheSegments)},
+		{"transaction-timeout", "PROGLOG_TRANSACTION_TIMEOUT", "how long a transaction can be open before it's aborted", (*durationValue)(&c.Transactions.Timeout)},
+		{"quota-produce-bytes-per-second", "PROGLOG_QUOTA_PRODUCE_BYTES_PER_SECOND", "default per-client produce byte rate (0 is unlimited)", (*float64Value)(&c.Quotas.Default.ProduceBytesPerSecond)},
+		{"quota-produce-requests-per-second", "PROGLOG_QUOTA_PRODUCE_REQUESTS_PER_SECOND", "default per-client produce request rate (0 is unlimited)", (*float64Value)(&c.Quotas.Default.ProduceRequestsPerSecond)},
+		{"quota-consume-bytes-per-second", "PROGLOG_QUOTA_CONSUME_BYTES_PER_SECOND", "default per-client consume byte rate (0 is unlimited)", (*float64Value)(&c.Quotas.Default.ConsumeBytesPerSecond)},
+		{"quota-consume-requests-per-second", "PROGLOG_QUOTA_CONSUME_REQUESTS_PER_SECOND", "default per-client consume request rate (0 is unlimited)", (*float64Value)(&c.Quotas.Default.ConsumeRequestsPerSecond)},
+	}
+}
+
+// Load builds the configuration from the defaults, the config file, the
+// environment (looked up with getenv) and the command-line args, then
+// validates it.
+func Load(name string, args []string, getenv func(string) string) (*Config, error) {
+	// parse the flags into a scratch config first: we need the config file's
+	// path before we know what the flags are overriding
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("config", getenv("PROGLOG_CONFIG"), "YAML or JSON config file (env PROGLOG_CONFIG)")
+	for _, s := range Default().settings() {
+		fs.Var(s.value, s.flag, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	c := Default()
+	if *path != "" {
+		err = c.readFile(*path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	settings := c.settings()
+	for _, s := range settings {
+		v := getenv(s.env)
+		if v == "" {
+			continue
+		}
+		err = s.value.Set(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", s.env, v, err)
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if err == nil && s.flag == f.Name {
+				err = s.value.Set(f.Value.String())
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.SnapshotDir == "" && c.DataDir != "" {
+		c.SnapshotDir = filepath.Clean(c.DataDir) + "-snapshots"
+	}
+	if c.SchemaDir == "" && c.DataDir != "" {
+		c.SchemaDir = filepath.Clean(c.DataDir) + "-schemas"
+	}
+	if c.Segment.MaxRecordBytes == 0 {
+		c.Segment.MaxRecordBytes = c.Segment.MaxStoreBytes
+	}
+	return c, c.Validate()
+}
+
+// readFile decodes the file at path over c. JSON is a subset of YAML, so one
+// decoder handles both.
+func (c *Config) readFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	err = yaml.Unmarshal(b, c)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// indexEntryWidth is the size of one index entry, the smallest index that can
+// hold a record.
+const indexEntryWidth = 12
+
+// Validate reports the first setting that the server couldn't start with.
+func (c *Config) Validate() error {
+	switch {
+	case c.Addr == "":
+		return errors.New("addr must be set")
+	case c.DataDir == "":
+		return errors.New("data dir must be set")
+	case c.Segment.MaxStoreBytes == 0:
+		return errors.New("segment max store bytes must be greater than zero")
+	case c.Segment.MaxIndexBytes < indexEntryWidth:
+		return fmt.Errorf("segment max index bytes must be at least %d", indexEntryWidth)
+	case c.Segment.MaxRecordBytes == 0:
+		return errors.New("segment max record bytes must be greater than zero")
+	case c.Segment.MaxRecordBytes > c.Segment.MaxStoreBytes:
+		return errors.New("segment max record bytes must not be more than the segment max store bytes")
+	case c.Retention.MaxBytes != 0 && c.Retention.MaxBytes < c.Segment.MaxStoreBytes:
+		return errors.New("retention max bytes must be at least the segment max store bytes")
+	case c.Durability.MaxBatch < 0:
+		return errors.New("group commit max batch must not be negative")
+	case c.Durability.MaxLinger < 0:
+		return errors.New("group commit max linger must not be negative")
+	case c.Retention.MaxAge < 0:
+		return errors.New("retention max age must not be negative")
+	case c.Encryption.ReencryptInterval < 0:
+		return errors.New("encryption reencrypt interval must not be negative")
+	case c.Tiering.Dir != "" && c.Tiering.Interval <= 0:
+		return errors.New("tiering interval must be greater than zero")
+	case c.Tiering.LocalAge < 0:
+		return errors.New("tiering local age must not be negative")
+	case c.Tiering.CacheSegments < 1:
+		return errors.New("tiering cache segments must be at least 1")
+	case c.Transactions.Timeout <= 0:
+		return errors.New("transaction timeout must be greater than zero")
+	case c.SchemaCompatibility != string(schema.Backward) && c.SchemaCompatibility != string(schema.None):
+		return fmt.Errorf("schema compatibility must be %s or %s", schema.Backward, schema.None)
+	}
+	err := c.Quotas.Default.validate()
+	if err != nil {
+		return fmt.Errorf("default quota: %v", err)
+	}
+	for name, q := range c.Quotas.Clients {
+		err = q.validate()
+		if err != nil {
+			return fmt.Errorf("quota of client %q: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (q Quota) validate() error {
+	if q.ProduceBytesPerSecond < 0 || q.ProduceRequestsPerSecond < 0 ||
+		q.ConsumeBytesPerSecond < 0 || q.ConsumeRequestsPerSecond < 0 {
+		return errors.New("rates must not be negative")
+	}
+	return nil
+}
+
+// SchemaConfig returns the settings the schema registry is opened with.
+func (c *Config) SchemaConfig() schema.Config {
+	return schema.Config{Compatibility: schema.Compatibility(c.SchemaCompatibility)}
+}
+
+// QuotaConfig returns the clients' quotas the server enforces.
+func (c *Config) QuotaConfig() *server.QuotaConfig {
+	qc := &server.QuotaConfig{
+		APIKeys: c.Quotas.APIKeys,
+		Default: server.Quota(c.Quotas.Default),
+		Clients: make(map[string]server.Quota, len(c.Quotas.Clients)),
+	}
+	for name, q := range c.Quotas.Clients {
+		qc.Clients[name] = server.Quota(q)
+	}
+	return qc
+}
+
+// LogConfig returns the settings the log is opened with.
+func (c *Config) LogConfig() log.Config {
+	var lc log.Config
+	lc.Segment.MaxStoreBytes = c.Segment.MaxStoreBytes
+	lc.Segment.MaxIndexBytes = c.Segment.MaxIndexBytes
+	lc.Segment.InitialOffset = c.Segment.InitialOffset
+	lc.Segment.MaxRecordBytes = c.Segment.MaxRecordBytes
+	lc.Durability.SyncOnAppend = c.Durability.SyncOnAppend
+	lc.Durability.MaxBatch = c.Durability.MaxBatch
+	lc.Durability.MaxLinger = c.Durability.MaxLinger
+	lc.Retention.MaxBytes = c.Retention.MaxBytes
+	lc.Retention.MaxAge = c.Retention.MaxAge
+	lc.Tiering.LocalAge = c.Tiering.LocalAge
+	lc.Tiering.CacheSegments = c.Tiering.CacheSegments
+	lc.Transactions.Timeout = c.Transactions.Timeout
+	return lc
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string { return string(*v) }
+
+type uint64Value uint64
+
+func (v *uint64Value) Set(s string) error {
+	n, err := strconv.ParseUint(s, 0, 64)
+	*v = uint64Value(n)
+	return err
+}
+
+func (v *uint64Value) String() string { return strconv.FormatUint(uint64(*v), 10) }
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	*v = intValue(n)
+	return err
+}
+
+func (v *intValue) String() string { return strconv.Itoa(int(*v)) }
+
+type float64Value float64
+
+func (v *float64Value) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	*v = float64Value(f)
+	return err
+}
+
+func (v *float64Value) String() string { return strconv.FormatFloat(float64(*v), 'g', -1, 64) }
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	*v = boolValue(b)
+	return err
+}
+
+func (v *boolValue) String() string { return strconv.FormatBool(bool(*v)) }
+
+// IsBoolFlag lets the flag be given without a value, as in -sync-on-append.
+func (v *boolValue) IsBoolFlag() bool { return true }
+
+type durationValue time.Duration
+
+func (v *durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	*v = durationValue(d)
+	return err
+}
+
+func (v *durationValue) String() string { return time.Duration(*v).String() }
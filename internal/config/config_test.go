@@ -0,0 +1,124 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	f, err := ioutil.TempFile("", "config_test*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+addr: ":9000"
+data_dir: /var/lib/proglog
+segment:
+  max_store_bytes: 4096
+retention:
+  max_age: 24h
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	env := map[string]string{
+		"PROGLOG_CONFIG":                  f.Name(),
+		"PROGLOG_ADDR":                    ":9001",
+		"PROGLOG_SEGMENT_MAX_STORE_BYTES": "8192",
+	}
+	c, err := Load("server", []string{"-addr", ":9002", "-sync-on-append"}, func(k string) string {
+		return env[k]
+	})
+	require.NoError(t, err)
+
+	// flag beats env beats file beats defaults
+	require.Equal(t, ":9002", c.Addr)
+	require.Equal(t, uint64(8192), c.Segment.MaxStoreBytes)
+	require.Equal(t, "/var/lib/proglog", c.DataDir)
+	require.Equal(t, "/var/lib/proglog-snapshots", c.SnapshotDir)
+	require.Equal(t, "/var/lib/proglog-schemas", c.SchemaDir)
+	require.Equal(t, "BACKWARD", c.SchemaCompatibility)
+	require.Equal(t, 24*time.Hour, c.Retention.MaxAge)
+	require.Equal(t, uint64(1024), c.Segment.MaxIndexBytes)
+	require.True(t, c.Durability.SyncOnAppend)
+
+	lc := c.LogConfig()
+	require.Equal(t, uint64(8192), lc.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(8192), lc.Segment.MaxRecordBytes)
+	require.True(t, lc.Durability.SyncOnAppend)
+}
+
+func TestLoadJSON(t *testing.T) {
+	f, err := ioutil.TempFile("", "config_test*.json")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`{"addr": ":9000", "segment": {"initial_offset": 16}}`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	c, err := Load("server", []string{"-config", f.Name()}, func(string) string { return "" })
+	require.NoError(t, err)
+	require.Equal(t, ":9000", c.Addr)
+	require.Equal(t, uint64(16), c.Segment.InitialOffset)
+}
+
+func TestLoadQuotas(t *testing.T) {
+	f, err := ioutil.TempFile("", "config_test*.yaml")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(`
+allowed_origins:
+  - https://dashboard.example.com
+quotas:
+  api_keys:
+    secret: team
+  default:
+    produce_requests_per_second: 10
+  clients:
+    team:
+      produce_bytes_per_second: 1048576
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	c, err := Load("server", []string{"-config", f.Name(), "-quota-consume-bytes-per-second", "2.5e5"},
+		func(string) string { return "" })
+	require.NoError(t, err)
+	require.Equal(t, []string{"https://dashboard.example.com"}, c.AllowedOrigins)
+	qc := c.QuotaConfig()
+	require.Equal(t, "team", qc.APIKeys["secret"])
+	require.Equal(t, float64(10), qc.Default.ProduceRequestsPerSecond)
+	require.Equal(t, float64(250000), qc.Default.ConsumeBytesPerSecond)
+	require.Equal(t, float64(1048576), qc.Clients["team"].ProduceBytesPerSecond)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	noenv := func(string) string { return "" }
+	for scenario, args := range map[string][]string{
+		"bad flag value":         {"-segment-max-store-bytes", "lots"},
+		"empty addr":             {"-addr", ""},
+		"index too small":        {"-segment-max-index-bytes", "4"},
+		"record above store":     {"-segment-max-record-bytes", "2048"},
+		"retention below store":  {"-retention-max-bytes", "10"},
+		"missing config file":    {"-config", "/nonexistent/proglog.yaml"},
+		"negative retention age": {"-retention-max-age", "-1h"},
+		"negative quota":         {"-quota-produce-bytes-per-second", "-1"},
+		"zero txn timeout":       {"-transaction-timeout", "0"},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			_, err := Load("server", args, noenv)
+			require.Error(t, err)
+		})
+	}
+
+	_, err := Load("server", nil, func(k string) string {
+		if k == "PROGLOG_SYNC_ON_APPEND" {
+			return "sometimes"
+		}
+		return ""
+	})
+	require.Error(t, err)
+}
@@ -0,0 +1,65 @@
+package log
+
+import (
+	api "github.com/andrwkng/proglog/api/v1"
+)
+
+// AppendResult is the outcome of an asynchronous append.
+type AppendResult struct {
+	Offset uint64
+	Err    error
+}
+
+// AppendAsync queues the record to be appended and returns a channel that
+// receives the result once the record's been written and, if the log syncs
+// on append, synced. Results arrive in the order AppendAsync was called, so a
+// failed append's successors haven't been acknowledged before it.
+//
+// AppendAsync blocks while the configured max in-flight appends are
+// outstanding. The record mustn't be modified until its result arrives.
+func (l *Log) AppendAsync(record *api.Record) <-chan AppendResult {
+	result := make(chan AppendResult, 1)
+	closed := func() <-chan AppendResult {
+		result <- AppendResult{Err: ErrLogClosed}
+		return result
+	}
+	select {
+	case l.inFlight <- struct{}{}:
+	case <-l.quit:
+		return closed()
+	}
+	l.asyncMu.Lock()
+	defer l.asyncMu.Unlock()
+	if l.asyncClosed {
+		<-l.inFlight
+		return closed()
+	}
+	// the in-flight limit leaves room in the queue, so this doesn't block
+	l.queued <- &appendRequest{record: record, done: result}
+	return result
+}
+
+// asyncCommit commits the queued asynchronous appends in order, batching
+// those queued together, until the queue's closed and drained.
+func (l *Log) asyncCommit() {
+	defer close(l.asyncDone)
+	for req := range l.queued {
+		batch := []*appendRequest{req}
+	drain:
+		for len(batch) < cap(l.queued) {
+			select {
+			case req, ok := <-l.queued:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		l.commit(batch)
+		for range batch {
+			<-l.inFlight
+		}
+	}
+}
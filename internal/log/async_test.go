@@ -0,0 +1,63 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAppendAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "append-async-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256
+	c.Durability.SyncOnAppend = true
+	c.Async.MaxInFlight = 4
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// more appends than can be in flight, one of them with a sequence
+	// number that skips ahead
+	var results []<-chan AppendResult
+	for i := 0; i < 20; i++ {
+		record := &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+		switch i {
+		case 9:
+			record.ProducerId = "producer"
+		case 10:
+			record.ProducerId = "producer"
+			record.Sequence = 5
+		}
+		results = append(results, log.AppendAsync(record))
+	}
+
+	var want uint64
+	for i, result := range results {
+		res := <-result
+		if i == 10 {
+			require.True(t, errors.Is(res.Err, ErrOutOfOrderSequence), "%v", res.Err)
+			continue
+		}
+		require.NoError(t, res.Err)
+		require.Equal(t, want, res.Offset)
+		record, err := log.Read(res.Offset)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+		want++
+	}
+
+	// appends queued before Close are committed; those after fail
+	pending := log.AppendAsync(&api.Record{Value: []byte("last")})
+	require.NoError(t, log.Close())
+	res := <-pending
+	require.NoError(t, res.Err)
+	require.Equal(t, want, res.Offset)
+	res = <-log.AppendAsync(&api.Record{Value: []byte("too late")})
+	require.Error(t, res.Err)
+}
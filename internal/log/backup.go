@@ -0,0 +1,270 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"time"
+)
+
+// manifestName is the name of the manifest in a backup archive. It's written
+// after the segment files, once their checksums are known.
+const manifestName = "MANIFEST.json"
+
+// segmentFileName matches the names of the files a segment is stored in.
+var segmentFileName = regexp.MustCompile(`^[0-9]+\.(store|index)$`)
+
+// Manifest describes the segments in a backup archive.
+type Manifest struct {
+	LowestOffset uint64            `json:"lowest_offset"`
+	NextOffset   uint64            `json:"next_offset"`
+	Segments     []ManifestSegment `json:"segments"`
+}
+
+// ManifestSegment describes one segment in a backup archive.
+type ManifestSegment struct {
+	BaseOffset uint64         `json:"base_offset"`
+	NextOffset uint64         `json:"next_offset"`
+	Files      []ManifestFile `json:"files"`
+}
+
+// ManifestFile is a file in a backup archive and its checksum.
+type ManifestFile struct {
+	Name   string `json:"name"`
+	Size   uint64 `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Backup writes a tar archive of the log's segments to w, followed by a
+// manifest of their offsets and checksums. The archive holds exactly the
+// records appended before Backup was called; appends only wait while the
+// segments' files are opened, not while they're written to w.
+func (l *Log) Backup(w io.Writer) (*Manifest, error) {
+	m, segments, err := l.backupSegments()
+	defer func() {
+		for _, s := range segments {
+			s.store.Close()
+		}
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(w)
+	for i, s := range segments {
+		for _, f := range []struct {
+			name string
+			r    io.Reader
+			size uint64
+		}{
+			{s.storeName, io.LimitReader(s.store, int64(s.storeBytes)), s.storeBytes},
+			{s.indexName, bytes.NewReader(s.index), uint64(len(s.index))},
+		} {
+			mf, err := archiveFile(tw, f.name, f.r, f.size)
+			if err != nil {
+				return nil, err
+			}
+			m.Segments[i].Files = append(m.Segments[i].Files, mf)
+		}
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = tw.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	return m, tw.Close()
+}
+
+// backupSegment is a segment's files as they were when a backup started.
+type backupSegment struct {
+	storeName string
+	indexName string
+	// store is opened on the segment's store, whose first storeBytes bytes
+	// don't change even if it's appended to, truncated or re-encrypted, since
+	// those either add to the file or replace it
+	store      *os.File
+	storeBytes uint64
+	// index holds a copy of the index's entries, without the space it was
+	// grown by
+	index []byte
+}
+
+// backupSegments opens the segments' files and copies their indexes under
+// the lock, returning the manifest without the files' checksums.
+func (l *Log) backupSegments() (*Manifest, []backupSegment, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, nil, ErrLogClosed
+	}
+
+	m := &Manifest{
+		LowestOffset: l.segments[0].baseOffset,
+		NextOffset:   l.segments[len(l.segments)-1].nextOffset,
+	}
+	var segments []backupSegment
+	for _, s := range l.segments {
+		// flush the store's buffer so the file holds every record we're
+		// about to archive
+		err := s.store.flush()
+		if err != nil {
+			return nil, segments, err
+		}
+		f, err := os.Open(s.store.Name())
+		if err != nil {
+			return nil, segments, err
+		}
+		segments = append(segments, backupSegment{
+			storeName:  path.Base(s.store.Name()),
+			indexName:  path.Base(s.index.Name()),
+			store:      f,
+			storeBytes: s.store.size,
+			index:      append([]byte(nil), s.index.mmap[:s.index.size]...),
+		})
+		m.Segments = append(m.Segments, ManifestSegment{BaseOffset: s.baseOffset, NextOffset: s.nextOffset})
+	}
+	return m, segments, nil
+}
+
+// archiveFile writes the size bytes read from r to tw as the file name.
+func archiveFile(tw *tar.Writer, name string, r io.Reader, size uint64) (ManifestFile, error) {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(size),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tw, h), r)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{
+		Name:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// Restore extracts an archive written by Backup into dir, which must be empty
+// or not exist, and checks the files against the archive's manifest. On error
+// it removes the files it extracted.
+func Restore(r io.Reader, dir string) (m *Manifest, err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		return nil, fmt.Errorf("restore into %s: directory isn't empty", dir)
+	}
+
+	restored := make(map[string]ManifestFile)
+	defer func() {
+		if err == nil {
+			return
+		}
+		for name := range restored {
+			os.Remove(path.Join(dir, name))
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == manifestName {
+			m = &Manifest{}
+			err = json.NewDecoder(tr).Decode(m)
+			if err != nil {
+				return nil, fmt.Errorf("decode manifest: %v", err)
+			}
+			continue
+		}
+		if !segmentFileName.MatchString(hdr.Name) {
+			return nil, fmt.Errorf("unexpected file %q in archive", hdr.Name)
+		}
+		mf, err := extractFile(tr, path.Join(dir, hdr.Name))
+		restored[hdr.Name] = mf
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m == nil {
+		return nil, errors.New("archive has no manifest")
+	}
+	var want int
+	for _, s := range m.Segments {
+		for _, mf := range s.Files {
+			want++
+			got, ok := restored[mf.Name]
+			if !ok {
+				return nil, fmt.Errorf("archive is missing %s", mf.Name)
+			}
+			if got != mf {
+				return nil, fmt.Errorf("%s doesn't match the manifest's checksum", mf.Name)
+			}
+		}
+	}
+	if len(restored) != want {
+		return nil, errors.New("archive has files missing from its manifest")
+	}
+	return m, nil
+}
+
+// extractFile writes the current file in tr to name, syncing it to disk.
+func extractFile(tr *tar.Reader, name string) (ManifestFile, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), tr)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	err = f.Sync()
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{
+		Name:   path.Base(name),
+		Size:   uint64(n),
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
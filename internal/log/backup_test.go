@@ -0,0 +1,131 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	var buf bytes.Buffer
+	m, err := l.Backup(&buf)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), m.LowestOffset)
+	require.Equal(t, uint64(3), m.NextOffset)
+	require.Equal(t, 2, len(m.Segments))
+	archive := buf.Bytes()
+
+	restoreDir, err := ioutil.TempDir("", "restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+	_, err = Restore(bytes.NewReader(archive), restoreDir)
+	require.NoError(t, err)
+
+	// restoring over existing segments isn't allowed
+	_, err = Restore(bytes.NewReader(archive), restoreDir)
+	require.Error(t, err)
+
+	r, err := NewLog(restoreDir, c)
+	require.NoError(t, err)
+	off, err := r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	for i := uint64(0); i < 3; i++ {
+		record, err := r.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+	off, err = r.Append(&api.Record{Value: []byte("after restore")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// a corrupt record fails the checksum and leaves nothing behind
+	corrupt := bytes.Replace(archive, []byte("hello world"), []byte("hello w0rld"), 1)
+	corruptDir, err := ioutil.TempDir("", "restore-corrupt-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(corruptDir)
+	_, err = Restore(bytes.NewReader(corrupt), corruptDir)
+	require.Error(t, err)
+	files, err := ioutil.ReadDir(corruptDir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+}
+
+// blockingWriter blocks its first write until it's released.
+type blockingWriter struct {
+	bytes.Buffer
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.started)
+		<-w.release
+	})
+	return w.Buffer.Write(p)
+}
+
+func TestBackupUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup-unlocked-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	w := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+	done := make(chan error)
+	var m *Manifest
+	go func() {
+		var err error
+		m, err = l.Backup(w)
+		done <- err
+	}()
+	<-w.started
+	// appends carry on while the archive's being written and aren't in it
+	_, err = l.Append(&api.Record{Value: []byte("during backup")})
+	require.NoError(t, err)
+	close(w.release)
+	require.NoError(t, <-done)
+	require.Equal(t, uint64(3), m.NextOffset)
+
+	restoreDir, err := ioutil.TempDir("", "restore-unlocked-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+	_, err = Restore(io.Reader(&w.Buffer), restoreDir)
+	require.NoError(t, err)
+	r, err := NewLog(restoreDir, c)
+	require.NoError(t, err)
+	defer r.Close()
+	off, err := r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
@@ -0,0 +1,454 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// quarantineDir is the subdirectory of a log's directory that Check moves
+// unrecoverable segments' files into. The log ignores subdirectories.
+const quarantineDir = "quarantine"
+
+// CheckOptions chooses which problems Check repairs. The zero value only
+// reports them.
+type CheckOptions struct {
+	// RebuildIndexes rewrites indexes that don't match their store's frames
+	// from the frames.
+	RebuildIndexes bool
+	// TruncateTails cuts stores off after their last well-formed frame, and
+	// indexes after their last entry that still points at a frame.
+	TruncateTails bool
+	// Quarantine moves segments that can't be repaired into the quarantine
+	// subdirectory.
+	Quarantine bool
+	// Keyring decrypts encrypted frames so their offsets can be checked.
+	// Without it, encrypted frames are only checked for being cut short.
+	Keyring *Keyring
+}
+
+// Issue kinds reported by Check.
+const (
+	IssueTornFrame      = "torn_frame"
+	IssueCorruptFrame   = "corrupt_frame"
+	IssueOffsetMismatch = "offset_mismatch"
+	IssueIndexMismatch  = "index_mismatch"
+	IssueIndexBehind    = "index_behind"
+	IssueIndexAhead     = "index_ahead"
+	IssueIndexGarbage   = "index_garbage"
+	IssueIndexPadding   = "index_padding"
+	IssueMissingIndex   = "missing_index"
+	IssueOrphanIndex    = "orphan_index"
+	IssueEmptyStore     = "no_valid_frames"
+	IssueGap            = "gap"
+	IssueOverlap        = "overlap"
+)
+
+// Issue is a problem found by Check.
+type Issue struct {
+	Segment uint64 `json:"segment"`
+	Kind    string `json:"kind"`
+	Detail  string `json:"detail"`
+	// Repaired is set if Check fixed the issue.
+	Repaired bool `json:"repaired"`
+}
+
+// SegmentReport is what Check found in, and did to, one segment.
+type SegmentReport struct {
+	BaseOffset uint64 `json:"base_offset"`
+	// NextOffset is the offset after the last record the log will read from
+	// the segment, after any repairs.
+	NextOffset uint64 `json:"next_offset"`
+	// Frames is the number of well-formed frames at the start of the store,
+	// which take up ValidStoreBytes of its StoreBytes.
+	Frames          uint64   `json:"frames"`
+	StoreBytes      uint64   `json:"store_bytes"`
+	ValidStoreBytes uint64   `json:"valid_store_bytes"`
+	IndexEntries    uint64   `json:"index_entries"`
+	Actions         []string `json:"actions,omitempty"`
+	Quarantined     bool     `json:"quarantined"`
+
+	// unrecoverable is set if the segment has no records to keep.
+	unrecoverable bool
+}
+
+// Report is the result of checking a log directory.
+type Report struct {
+	Dir      string          `json:"dir"`
+	Segments []SegmentReport `json:"segments"`
+	Issues   []Issue         `json:"issues"`
+}
+
+// Clean reports whether Check found no issues.
+func (r *Report) Clean() bool {
+	return len(r.Issues) == 0
+}
+
+// Unrepaired returns the number of issues Check didn't fix.
+func (r *Report) Unrepaired() int {
+	var n int
+	for _, i := range r.Issues {
+		if !i.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// Check walks every segment in dir, checking that store frames are well
+// formed and hold consecutive offsets, that index entries point at those
+// frames in order, and that each segment's base offset follows on from the
+// previous segment's next offset. It repairs what opts asks it to.
+//
+// Check works on the files directly, so the log must not be open.
+func Check(dir string, opts CheckOptions) (*Report, error) {
+	report := &Report{Dir: dir, Issues: []Issue{}}
+	err := checkOrphans(dir, opts, report)
+	if err != nil {
+		return nil, err
+	}
+	offs, err := baseOffsets(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var prev *SegmentReport
+	for _, off := range offs {
+		info := SegmentInfo{Dir: dir, BaseOffset: off}
+		sr, issues, err := checkSegment(info, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		// a segment with nothing to read doesn't take up any offsets, so only
+		// a segment with a record can overlap the one before
+		if prev != nil && sr.NextOffset > sr.BaseOffset {
+			switch {
+			case sr.BaseOffset > prev.NextOffset:
+				issues = append(issues, Issue{
+					Segment: off,
+					Kind:    IssueGap,
+					Detail:  fmt.Sprintf("offsets %d to %d are missing", prev.NextOffset, sr.BaseOffset-1),
+				})
+			case sr.BaseOffset < prev.NextOffset:
+				issues = append(issues, Issue{
+					Segment: off,
+					Kind:    IssueOverlap,
+					Detail:  fmt.Sprintf("segment %d already holds offsets up to %d", prev.BaseOffset, prev.NextOffset-1),
+				})
+				sr.unrecoverable = true
+			}
+		}
+		if sr.unrecoverable {
+			// the segment's offsets don't count towards the chain whether or
+			// not we move it out of the way
+			if opts.Quarantine {
+				err = quarantine(dir, info.StorePath(), info.IndexPath())
+				if err != nil {
+					return nil, err
+				}
+				sr.Quarantined = true
+				sr.Actions = append(sr.Actions, "quarantined")
+				for i := range issues {
+					issues[i].Repaired = true
+				}
+			}
+			report.Segments = append(report.Segments, *sr)
+			report.Issues = append(report.Issues, issues...)
+			continue
+		}
+		report.Segments = append(report.Segments, *sr)
+		report.Issues = append(report.Issues, issues...)
+		prev = &report.Segments[len(report.Segments)-1]
+	}
+
+	for _, sr := range report.Segments {
+		if len(sr.Actions) > 0 {
+			// the state checkpoints may stand for records that were cut off
+			// or moved out, so have the log replay the records that are left
+			err = removeCheckpoints(dir)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return report, nil
+}
+
+// checkOrphans reports index files without a store, which the log would
+// ignore, quarantining them if asked to.
+func checkOrphans(dir string, opts CheckOptions, report *Report) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || path.Ext(file.Name()) != ".index" {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".index"), 10, 0)
+		if err != nil {
+			continue
+		}
+		info := SegmentInfo{Dir: dir, BaseOffset: off}
+		_, err = os.Stat(info.StorePath())
+		if !os.IsNotExist(err) {
+			continue
+		}
+		issue := Issue{Segment: off, Kind: IssueOrphanIndex, Detail: file.Name() + " has no store"}
+		if opts.Quarantine {
+			err = quarantine(dir, info.IndexPath())
+			if err != nil {
+				return err
+			}
+			issue.Repaired = true
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+	return nil
+}
+
+// checkSegment checks one segment, repairing it as asked, and marks it
+// unrecoverable if it has no records to keep.
+func checkSegment(info SegmentInfo, opts CheckOptions) (*SegmentReport, []Issue, error) {
+	sr := &SegmentReport{BaseOffset: info.BaseOffset}
+	var issues []Issue
+	issue := func(kind, format string, args ...interface{}) {
+		issues = append(issues, Issue{
+			Segment: info.BaseOffset,
+			Kind:    kind,
+			Detail:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	b, err := ioutil.ReadFile(info.StorePath())
+	if err != nil {
+		return nil, nil, err
+	}
+	sr.StoreBytes = uint64(len(b))
+	frames, tail := scanFrames(b, info.BaseOffset, opts.Keyring)
+	sr.Frames = uint64(len(frames))
+	sr.ValidStoreBytes = sr.StoreBytes
+	if tail != nil {
+		sr.ValidStoreBytes = tail.pos
+		issue(tail.kind, "%s at position %d, %d bytes from the end of the store",
+			tail.detail, tail.pos, sr.StoreBytes-tail.pos)
+	}
+
+	indexOK := true
+	entries, err := ReadIndexEntries(info.IndexPath())
+	if os.IsNotExist(err) {
+		issue(IssueMissingIndex, "%s doesn't exist", path.Base(info.IndexPath()))
+		indexOK = false
+	} else if err != nil {
+		return nil, nil, err
+	}
+	sr.IndexEntries = uint64(len(entries))
+
+	// count the entries that point at the frames they should
+	valid := validEntries(entries, sr.StoreBytes)
+	var matched int
+	for matched < len(valid) && matched < len(frames) && valid[matched].Pos == frames[matched] {
+		matched++
+	}
+	switch {
+	case matched < len(valid) && matched < len(frames):
+		issue(IssueIndexMismatch, "entry %d points at position %d, but the frame is at %d",
+			matched, valid[matched].Pos, frames[matched])
+		indexOK = false
+	case len(valid) > len(frames):
+		issue(IssueIndexAhead, "%d entries point past the last well-formed frame", len(valid)-len(frames))
+		indexOK = false
+	case len(valid) < len(frames):
+		issue(IssueIndexBehind, "%d frames at the end of the store aren't indexed", len(frames)-len(valid))
+		indexOK = false
+	}
+	// an index that wasn't closed is still padded out with zeroed entries,
+	// which the log would take for records
+	padding := IssueIndexPadding
+	for _, e := range entries[len(valid):] {
+		if e != (IndexEntry{}) {
+			padding = IssueIndexGarbage
+			break
+		}
+	}
+	if len(entries) > len(valid) {
+		issue(padding, "%d entries follow the last valid entry", len(entries)-len(valid))
+		indexOK = false
+	}
+
+	if len(frames) == 0 && sr.StoreBytes > 0 {
+		issue(IssueEmptyStore, "the store holds %d bytes but no well-formed frames", sr.StoreBytes)
+		sr.unrecoverable = true
+	}
+
+	if opts.TruncateTails && tail != nil {
+		err = os.Truncate(info.StorePath(), int64(sr.ValidStoreBytes))
+		if err != nil {
+			return nil, nil, err
+		}
+		sr.Actions = append(sr.Actions, fmt.Sprintf("truncated store to %d bytes", sr.ValidStoreBytes))
+		// the tail was the first issue found
+		issues[0].Repaired = true
+	}
+
+	if opts.TruncateTails && !opts.RebuildIndexes && len(entries) > matched {
+		// drop the entries past the last one that points at a frame
+		err = writeIndex(info.IndexPath(), valid[:matched])
+		if err != nil {
+			return nil, nil, err
+		}
+		sr.Actions = append(sr.Actions, fmt.Sprintf("truncated index to %d entries", matched))
+		for i := range issues {
+			switch issues[i].Kind {
+			case IssueIndexAhead, IssueIndexPadding, IssueIndexGarbage:
+				issues[i].Repaired = true
+			}
+		}
+	}
+
+	if opts.RebuildIndexes && !indexOK {
+		rebuilt := make([]IndexEntry, len(frames))
+		for i, pos := range frames {
+			rebuilt[i] = IndexEntry{Offset: uint32(i), Pos: pos}
+		}
+		err = writeIndex(info.IndexPath(), rebuilt)
+		if err != nil {
+			return nil, nil, err
+		}
+		sr.Actions = append(sr.Actions, fmt.Sprintf("rebuilt index with %d entries", len(rebuilt)))
+		for i := range issues {
+			if strings.HasPrefix(issues[i].Kind, "index_") || issues[i].Kind == IssueMissingIndex {
+				issues[i].Repaired = true
+			}
+		}
+		matched = len(frames)
+	}
+
+	sr.NextOffset = info.BaseOffset + uint64(matched)
+	return sr, issues, nil
+}
+
+// badFrame describes where and why a store's well-formed frames end.
+type badFrame struct {
+	pos    uint64
+	kind   string
+	detail string
+}
+
+// scanFrames returns the positions of the well-formed frames in the store b,
+// stopping at the first one that is cut short, doesn't decode or holds the
+// wrong offset. Encrypted frames are decrypted with keys, or taken as they
+// are if keys is nil or doesn't hold their key.
+func scanFrames(b []byte, baseOffset uint64, keys *Keyring) ([]uint64, *badFrame) {
+	var frames []uint64
+	size := uint64(len(b))
+	for pos := uint64(0); pos < size; {
+		if size-pos < lenWidth {
+			return frames, &badFrame{pos, IssueTornFrame, "frame length cut short"}
+		}
+		n := enc.Uint64(b[pos : pos+lenWidth])
+		if n > size-pos-lenWidth {
+			return frames, &badFrame{pos, IssueTornFrame, fmt.Sprintf("frame of %d bytes cut short", n)}
+		}
+		p := b[pos+lenWidth : pos+lenWidth+n]
+		id, err := frameKey(p)
+		if err != nil {
+			return frames, &badFrame{pos, IssueCorruptFrame, fmt.Sprintf("frame doesn't decode (%v)", err)}
+		}
+		if id != "" && !keys.has(id) {
+			// without the key, all that can be checked is the frame's length;
+			// treating it as corrupt would have fsck cut off good records
+			frames = append(frames, pos)
+			pos += lenWidth + n
+			continue
+		}
+		p, err = decodeFrame(keys, p)
+		if err != nil {
+			return frames, &badFrame{pos, IssueCorruptFrame, fmt.Sprintf("frame doesn't decrypt (%v)", err)}
+		}
+		record := &api.Record{}
+		err = proto.Unmarshal(p, record)
+		if err != nil {
+			return frames, &badFrame{pos, IssueCorruptFrame, fmt.Sprintf("frame doesn't decode (%v)", err)}
+		}
+		want := baseOffset + uint64(len(frames))
+		if record.Offset != want {
+			return frames, &badFrame{pos, IssueOffsetMismatch, fmt.Sprintf("frame holds offset %d, want %d", record.Offset, want)}
+		}
+		frames = append(frames, pos)
+		pos += lenWidth + n
+	}
+	return frames, nil
+}
+
+// writeIndex replaces the index file at name with one holding entries,
+// trimmed to size as if the index had been closed. The new index is synced
+// before it's renamed over the old one, and the directory after, so a crash
+// leaves one or the other.
+func writeIndex(name string, entries []IndexEntry) error {
+	b := make([]byte, uint64(len(entries))*entWidth)
+	for i, e := range entries {
+		pos := uint64(i) * entWidth
+		enc.PutUint32(b[pos:pos+offWidth], e.Offset)
+		enc.PutUint64(b[pos+offWidth:pos+entWidth], e.Pos)
+	}
+	tmp, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		return err
+	}
+	return syncDir(path.Dir(name))
+}
+
+// syncDir commits the entries of dir, like files renamed into it, to stable
+// storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// quarantine moves the named files into dir's quarantine subdirectory.
+func quarantine(dir string, names ...string) error {
+	qdir := path.Join(dir, quarantineDir)
+	err := os.MkdirAll(qdir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = os.Rename(name, path.Join(qdir, path.Base(name)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, dir string, c Config,
+	){
+		"clean log":                        testCheckClean,
+		"repair crashed log":               testCheckRepairCrash,
+		"quarantine overlapping segment":   testCheckQuarantine,
+		"report without repairing changes": testCheckReportOnly,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "check-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+			fn(t, dir, c)
+		})
+	}
+}
+
+// crashLog appends three records over two segments and leaves the log as a
+// crash would: with a torn frame at the end of the active store and the
+// indexes still padded out.
+func crashLog(t *testing.T, dir string, c Config) {
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.activeSegment.Sync())
+
+	f, err := os.OpenFile(l.activeSegment.store.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	b := make([]byte, lenWidth+3)
+	enc.PutUint64(b, 100)
+	_, err = f.Write(b)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func testCheckClean(t *testing.T, dir string, c Config) {
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	report, err := Check(dir, CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Issues)
+	require.Equal(t, 2, len(report.Segments))
+	require.Equal(t, uint64(2), report.Segments[1].BaseOffset)
+	require.Equal(t, uint64(3), report.Segments[1].NextOffset)
+}
+
+func testCheckRepairCrash(t *testing.T, dir string, c Config) {
+	crashLog(t, dir, c)
+	checkpoints, err := filepath.Glob(path.Join(dir, "*"+stateExt))
+	require.NoError(t, err)
+	require.NotEmpty(t, checkpoints)
+
+	report, err := Check(dir, CheckOptions{TruncateTails: true, RebuildIndexes: true})
+	require.NoError(t, err)
+	require.False(t, report.Clean())
+	require.Equal(t, 0, report.Unrepaired())
+	kinds := map[string]bool{}
+	for _, i := range report.Issues {
+		kinds[i.Kind] = true
+	}
+	require.True(t, kinds[IssueTornFrame])
+	require.True(t, kinds[IssueIndexPadding])
+	// the repaired log's state is rebuilt from its records
+	checkpoints, err = filepath.Glob(path.Join(dir, "*"+stateExt))
+	require.NoError(t, err)
+	require.Empty(t, checkpoints)
+
+	report, err = Check(dir, CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Issues)
+
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = l.Append(&api.Record{Value: []byte("after repair")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	record, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after repair"), record.Value)
+}
+
+func testCheckQuarantine(t *testing.T, dir string, c Config) {
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// a segment that claims offset 1 overlaps the first segment
+	s, err := newSegment(dir, 1, l.Config)
+	require.NoError(t, err)
+	_, err = s.Append(&api.Record{Value: []byte("overlap")})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	report, err := Check(dir, CheckOptions{Quarantine: true})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(report.Issues))
+	require.Equal(t, IssueOverlap, report.Issues[0].Kind)
+	require.True(t, report.Issues[0].Repaired)
+	require.True(t, report.Segments[1].Quarantined)
+	_, err = os.Stat(path.Join(dir, quarantineDir, "1.store"))
+	require.NoError(t, err)
+
+	report, err = Check(dir, CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean(), "%v", report.Issues)
+}
+
+func testCheckReportOnly(t *testing.T, dir string, c Config) {
+	crashLog(t, dir, c)
+	before, err := InspectDir(dir)
+	require.NoError(t, err)
+
+	report, err := Check(dir, CheckOptions{})
+	require.NoError(t, err)
+	require.Equal(t, len(report.Issues), report.Unrepaired())
+
+	after, err := InspectDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
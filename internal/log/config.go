@@ -1,9 +1,62 @@
 package log
 
+import "time"
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// MaxRecordBytes is the largest encoded record Append accepts, so
+		// that no segment outgrows MaxStoreBytes by more than that. It can't
+		// be more than MaxStoreBytes, which it defaults to.
+		MaxRecordBytes uint64
+	}
+	Durability struct {
+		// SyncOnAppend flushes the store buffer and fsyncs the active segment
+		// after every append rather than leaving it to Close.
+		SyncOnAppend bool
+		// MaxBatch turns on group commit when it's more than one: concurrent
+		// appends are queued and written together, up to MaxBatch at a time,
+		// and covered by a single sync.
+		MaxBatch int
+		// MaxLinger is how long a batch waits for more appends after its
+		// first before it's written. Zero writes whatever's queued at once.
+		MaxLinger time.Duration
+	}
+	Retention struct {
+		// MaxBytes caps the combined size of the segments' stores, removing the
+		// oldest segments once it's exceeded. Zero keeps everything.
+		MaxBytes uint64
+		// MaxAge removes segments that haven't been written to for longer
+		// than this. Zero keeps everything.
+		MaxAge time.Duration
+	}
+	Encryption struct {
+		// Keyring, if set, encrypts new segments' frames with its active key
+		// and decrypts frames encrypted with any of its keys.
+		Keyring *Keyring
+	}
+	Tiering struct {
+		// Blobs, if set, is the blob store Offload uploads sealed segments
+		// to, and reads of offsets that are no longer local fetch them from.
+		Blobs BlobStore
+		// LocalAge removes the local copies of uploaded segments that
+		// haven't been written to for longer than this. Zero keeps them.
+		LocalAge time.Duration
+		// CacheSegments caps how many fetched segments are kept locally,
+		// 4 by default.
+		CacheSegments int
+	}
+	Transactions struct {
+		// Timeout aborts transactions that have been open for longer than
+		// this, so an abandoned one can't hold back read-committed consumers
+		// for good. A minute by default.
+		Timeout time.Duration
+	}
+	Async struct {
+		// MaxInFlight caps how many AppendAsync appends can be outstanding;
+		// AppendAsync blocks while there are that many. 64 by default.
+		MaxInFlight int
 	}
 }
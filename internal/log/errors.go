@@ -0,0 +1,96 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var (
+	// ErrRecordTooLarge is returned, as a *RecordTooLargeError, when a
+	// record is bigger than the log's max record size.
+	ErrRecordTooLarge = errors.New("record too large")
+	// ErrOffsetOutOfRange is returned, as an *OffsetOutOfRangeError, when
+	// reading an offset the log doesn't hold.
+	ErrOffsetOutOfRange = errors.New("offset out of range")
+	// ErrCorruptRecord is returned, as a *CorruptRecordError, when a record
+	// the log should hold can't be read back from its segment.
+	ErrCorruptRecord = errors.New("corrupt record")
+	// ErrLogClosed is returned when using a log that's been closed.
+	ErrLogClosed = errors.New("log is closed")
+)
+
+// RecordTooLargeError is a record that was refused for its size.
+type RecordTooLargeError struct {
+	// Size is the size of the encoded record and Max the most the log
+	// accepts.
+	Size uint64
+	Max  uint64
+}
+
+func (e *RecordTooLargeError) Error() string {
+	return fmt.Sprintf("record too large: %d bytes, max %d", e.Size, e.Max)
+}
+
+// Is makes the error match ErrRecordTooLarge.
+func (e *RecordTooLargeError) Is(target error) bool {
+	return target == ErrRecordTooLarge
+}
+
+// OffsetOutOfRangeError is a read of an offset outside the log.
+type OffsetOutOfRangeError struct {
+	Offset uint64
+	// Lowest is the log's lowest offset and Next the offset its next record
+	// will be written at, so the log holds the offsets in [Lowest, Next).
+	Lowest uint64
+	Next   uint64
+}
+
+func (e *OffsetOutOfRangeError) Error() string {
+	return fmt.Sprintf("offset out of range: %d not in [%d, %d)", e.Offset, e.Lowest, e.Next)
+}
+
+// Is makes the error match ErrOffsetOutOfRange.
+func (e *OffsetOutOfRangeError) Is(target error) bool {
+	return target == ErrOffsetOutOfRange
+}
+
+// CorruptRecordError is a record whose index entry or stored frame couldn't
+// be read or decoded.
+type CorruptRecordError struct {
+	Offset uint64
+	Err    error
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record at offset %d: %v", e.Offset, e.Err)
+}
+
+// Is makes the error match ErrCorruptRecord.
+func (e *CorruptRecordError) Is(target error) bool {
+	return target == ErrCorruptRecord
+}
+
+func (e *CorruptRecordError) Unwrap() error { return e.Err }
+
+// corrupt wraps an error reading the record at off in a CorruptRecordError,
+// unless the record couldn't be read because of the file system or a missing
+// key rather than what's stored.
+func corrupt(off uint64, err error) error {
+	var pathErr *os.PathError
+	if err == nil || errors.As(err, &pathErr) ||
+		errors.Is(err, ErrNoKeyring) || errors.Is(err, ErrUnknownKey) {
+		return err
+	}
+	return &CorruptRecordError{Offset: off, Err: err}
+}
+
+// outOfRange returns the error for reading off, which the log doesn't hold.
+// The log must be locked.
+func (l *Log) outOfRange(off uint64) error {
+	return &OffsetOutOfRangeError{
+		Offset: off,
+		Lowest: l.lowestOffset(),
+		Next:   l.activeSegment.nextOffset,
+	}
+}
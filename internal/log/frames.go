@@ -0,0 +1,199 @@
+package log
+
+import (
+	"bufio"
+	"io"
+	"os"
+)
+
+// Frames is a run of records read from the log as the frames they're stored
+// in: each an 8-byte big-endian length followed by that many bytes of a
+// protobuf-encoded api.Record. Encrypted frames are decrypted as they're
+// written, so only plaintext segments are sent without being copied through
+// user space.
+//
+// The records are read uncommitted and include transaction markers. Frames
+// hold their own handles on the store files, so they keep the records they
+// were read with even if the log's truncated before they're written.
+type Frames struct {
+	// NextOffset is the offset after the last record in the run.
+	NextOffset uint64
+	ranges     []frameRange
+}
+
+// frameRange is a run of consecutive frames in one segment's store, read
+// through its own handle on the file so it stays readable if the segment's
+// removed.
+type frameRange struct {
+	file   *os.File
+	pos    uint64
+	size   uint64
+	frames uint64
+	// keys decrypts the frames, if the log's encrypted
+	keys *Keyring
+}
+
+// ReadFrames returns the frames of up to max records starting at from. Like
+// Scan, it returns no frames once from has passed the end of the log, and
+// fetches uploaded segments without holding the log's lock. The caller must
+// close the Frames.
+func (l *Log) ReadFrames(from uint64, max int) (*Frames, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	if from < l.lowestOffset() {
+		return nil, l.outOfRange(from)
+	}
+	frames := &Frames{NextOffset: from}
+	for left := uint64(max); left > 0; {
+		off := frames.NextOffset
+		var r frameRange
+		var err error
+		if s := l.segmentFor(off); s != nil {
+			r, err = s.frames(off, left)
+		} else if rs, ok, ferr := l.fetchRemote(off); ok {
+			err = ferr
+			if err == nil {
+				r, err = l.cache.frames(rs, off, left)
+			}
+		} else {
+			break
+		}
+		if err != nil {
+			frames.Close()
+			return nil, err
+		}
+		if r.frames == 0 {
+			r.file.Close()
+			break
+		}
+		frames.ranges = append(frames.ranges, r)
+		frames.NextOffset += r.frames
+		left -= r.frames
+	}
+	return frames, nil
+}
+
+// Size returns how many bytes WriteTo writes, if that's known before they're
+// written. It isn't if any of the frames are encrypted, since they're
+// decrypted as they're written.
+func (f *Frames) Size() (uint64, bool) {
+	var size uint64
+	for _, r := range f.ranges {
+		if r.keys != nil {
+			return 0, false
+		}
+		size += r.size
+	}
+	return size, true
+}
+
+// WriteTo writes the frames to w. Plaintext runs are copied straight from the
+// store files, which lets w use sendfile if it's a network connection or an
+// http.ResponseWriter.
+func (f *Frames) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for _, r := range f.ranges {
+		var n int64
+		var err error
+		if r.keys == nil {
+			_, err = r.file.Seek(int64(r.pos), io.SeekStart)
+			if err == nil {
+				n, err = io.Copy(w, io.LimitReader(r.file, int64(r.size)))
+			}
+		} else {
+			n, err = r.decrypt(w)
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// decrypt writes the range's frames to w, decrypting those that are
+// encrypted.
+func (r frameRange) decrypt(w io.Writer) (int64, error) {
+	var written int64
+	br := bufio.NewReader(io.NewSectionReader(r.file, int64(r.pos), int64(r.size)))
+	l := make([]byte, lenWidth)
+	for i := uint64(0); i < r.frames; i++ {
+		_, err := io.ReadFull(br, l)
+		if err != nil {
+			return written, err
+		}
+		p := make([]byte, enc.Uint64(l))
+		_, err = io.ReadFull(br, p)
+		if err != nil {
+			return written, err
+		}
+		p, err = decodeFrame(r.keys, p)
+		if err != nil {
+			return written, err
+		}
+		enc.PutUint64(l, uint64(len(p)))
+		n, err := w.Write(l)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		n, err = w.Write(p)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the store files the frames are read from.
+func (f *Frames) Close() error {
+	var err error
+	for _, r := range f.ranges {
+		cerr := r.file.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	f.ranges = nil
+	return err
+}
+
+// frames returns the run of up to max frames in the segment starting at from.
+func (s *segment) frames(from, max uint64) (frameRange, error) {
+	n := s.nextOffset - from
+	if n > max {
+		n = max
+	}
+	r := frameRange{frames: n, keys: s.store.keys}
+	// the run's frames must be in the file, not the write buffer
+	err := s.store.flush()
+	if err != nil {
+		return r, err
+	}
+	r.file, err = os.Open(s.store.Name())
+	if err != nil {
+		return r, err
+	}
+	if n == 0 {
+		return r, nil
+	}
+	_, r.pos, err = s.index.Read(int64(from - s.baseOffset))
+	if err != nil {
+		r.file.Close()
+		return r, err
+	}
+	end := s.store.size
+	if from+n < s.nextOffset {
+		_, end, err = s.index.Read(int64(from + n - s.baseOffset))
+		if err != nil {
+			r.file.Close()
+			return r, err
+		}
+	}
+	r.size = end - r.pos
+	return r, nil
+}
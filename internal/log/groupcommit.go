@@ -0,0 +1,127 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+)
+
+// appendRequest is an append queued for the group committer.
+type appendRequest struct {
+	record *api.Record
+	done   chan AppendResult
+}
+
+// groupAppend queues the record for the group committer and waits for it to
+// be written and synced.
+func (l *Log) groupAppend(record *api.Record) (uint64, error) {
+	req := &appendRequest{record: record, done: make(chan AppendResult, 1)}
+	select {
+	case l.commits <- req:
+	case <-l.quit:
+		return 0, ErrLogClosed
+	}
+	res := <-req.done
+	return res.Offset, res.Err
+}
+
+// groupCommit collects queued appends into batches and commits them until
+// the log's closed.
+func (l *Log) groupCommit() {
+	defer close(l.committed)
+	for {
+		var batch []*appendRequest
+		select {
+		case req := <-l.commits:
+			batch = append(batch, req)
+		case <-l.quit:
+			return
+		}
+		batch = l.collect(batch)
+		l.commit(batch)
+	}
+}
+
+// collect adds queued appends to the batch until it's full or, once the max
+// linger has passed since its first append, nothing else is queued.
+func (l *Log) collect(batch []*appendRequest) []*appendRequest {
+	max := l.Config.Durability.MaxBatch
+	var linger <-chan time.Time
+	if d := l.Config.Durability.MaxLinger; d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		linger = t.C
+	}
+	for len(batch) < max {
+		if linger == nil {
+			select {
+			case req := <-l.commits:
+				batch = append(batch, req)
+				continue
+			default:
+				return batch
+			}
+		}
+		select {
+		case req := <-l.commits:
+			batch = append(batch, req)
+		case <-linger:
+			linger = nil
+		case <-l.quit:
+			return batch
+		}
+	}
+	return batch
+}
+
+// commit appends the batch's records under one hold of the lock, syncs the
+// active segment once if the log syncs on append, and then tells each caller
+// how its append went.
+func (l *Log) commit(batch []*appendRequest) {
+	l.mu.Lock()
+	results := make([]AppendResult, len(batch))
+	written := false
+	for i, req := range batch {
+		if l.closed {
+			results[i].Err = ErrLogClosed
+			continue
+		}
+		results[i].Offset, results[i].Err = l.append(req.record)
+		written = written || results[i].Err == nil
+	}
+	if written && l.Config.Durability.SyncOnAppend {
+		err := l.activeSegment.Sync()
+		if err != nil {
+			for i := range results {
+				if results[i].Err == nil {
+					results[i].Err = err
+				}
+			}
+		}
+	}
+	l.batches++
+	l.mu.Unlock()
+
+	for i, req := range batch {
+		req.done <- results[i]
+	}
+}
+
+// stopCommitters stops the group committer, if there is one, and the
+// asynchronous appends' committer, once they've committed what's queued.
+func (l *Log) stopCommitters() {
+	if l.quit == nil {
+		return
+	}
+	l.quitOnce.Do(func() { close(l.quit) })
+	l.asyncMu.Lock()
+	if !l.asyncClosed {
+		l.asyncClosed = true
+		close(l.queued)
+	}
+	l.asyncMu.Unlock()
+	<-l.asyncDone
+	if l.commits != nil {
+		<-l.committed
+	}
+}
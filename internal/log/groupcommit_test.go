@@ -0,0 +1,60 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "group-commit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256
+	c.Durability.SyncOnAppend = true
+	c.Durability.MaxBatch = 8
+	c.Durability.MaxLinger = 50 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	const n = 32
+	offsets := make([]uint64, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			off, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			require.NoError(t, err)
+			offsets[i] = off
+		}(i)
+	}
+	wg.Wait()
+
+	// every append got its own offset, holding its own record
+	seen := make(map[uint64]bool)
+	for i, off := range offsets {
+		require.False(t, seen[off], "offset %d handed out twice", off)
+		seen[off] = true
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), record.Value)
+	}
+	require.True(t, log.batches < n, "%d batches for %d appends", log.batches, n)
+	for _, s := range log.segments {
+		fi, err := os.Stat(s.store.Name())
+		require.NoError(t, err)
+		require.Equal(t, int64(s.store.size), fi.Size())
+	}
+
+	require.NoError(t, log.Close())
+	_, err = log.Append(&api.Record{Value: []byte("too late")})
+	require.Error(t, err)
+}
@@ -80,6 +80,21 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// truncate drops the entries past size bytes, zeroing them so they don't
+// look written if the log isn't closed cleanly.
+func (i *index) truncate(size uint64) error {
+	for b := size; b < i.size; b++ {
+		i.mmap[b] = 0
+	}
+	i.size = size
+	return i.Sync()
+}
+
+// Sync flushes the entries written to the memory-mapped file to stable storage.
+func (i *index) Sync() error {
+	return i.mmap.Sync(gommap.MS_SYNC)
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
@@ -0,0 +1,286 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// The functions in this file read a log directory's files directly and never
+// open them for writing, so they're safe to run against the files of a log
+// that crashed or is still open in another process.
+
+// SegmentInfo describes a segment as found on disk.
+type SegmentInfo struct {
+	Dir        string `json:"-"`
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	StoreBytes uint64 `json:"store_bytes"`
+	IndexBytes uint64 `json:"index_bytes"`
+	// Entries is the number of index entries that belong to records; any
+	// entries after them are left over from a log that wasn't closed.
+	Entries uint64 `json:"entries"`
+}
+
+// IndexEntry is an index entry: a record's offset relative to its segment's
+// base offset and the position of its frame in the store.
+type IndexEntry struct {
+	Offset uint32 `json:"offset"`
+	Pos    uint64 `json:"pos"`
+}
+
+// StorePath returns the path of the segment's store file.
+func (s SegmentInfo) StorePath() string {
+	return path.Join(s.Dir, fmt.Sprintf("%d%s", s.BaseOffset, ".store"))
+}
+
+// IndexPath returns the path of the segment's index file.
+func (s SegmentInfo) IndexPath() string {
+	return path.Join(s.Dir, fmt.Sprintf("%d%s", s.BaseOffset, ".index"))
+}
+
+// baseOffsets returns the base offsets of the segments stored in dir, sorted
+// from oldest to newest.
+func baseOffsets(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var offs []uint64
+	for _, file := range files {
+		if file.IsDir() || path.Ext(file.Name()) != ".store" {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".store"), 10, 0)
+		if err != nil {
+			continue
+		}
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, j int) bool {
+		return offs[i] < offs[j]
+	})
+	return offs, nil
+}
+
+// InspectDir describes the segments in dir, oldest first.
+func InspectDir(dir string) ([]SegmentInfo, error) {
+	offs, err := baseOffsets(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []SegmentInfo
+	for _, off := range offs {
+		s := SegmentInfo{Dir: dir, BaseOffset: off}
+		fi, err := os.Stat(s.StorePath())
+		if err != nil {
+			return nil, err
+		}
+		s.StoreBytes = uint64(fi.Size())
+		fi, err = os.Stat(s.IndexPath())
+		if err != nil {
+			return nil, err
+		}
+		s.IndexBytes = uint64(fi.Size())
+		entries, err := ReadIndexEntries(s.IndexPath())
+		if err != nil {
+			return nil, err
+		}
+		s.Entries = uint64(len(validEntries(entries, s.StoreBytes)))
+		s.NextOffset = s.BaseOffset + s.Entries
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// ReadIndexEntries returns every entry in the index file at path, including
+// any zeroed entries left over from the file being grown to its max size.
+func ReadIndexEntries(path string) ([]IndexEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]IndexEntry, 0, uint64(len(b))/entWidth)
+	for pos := uint64(0); pos+entWidth <= uint64(len(b)); pos += entWidth {
+		entries = append(entries, IndexEntry{
+			Offset: enc.Uint32(b[pos : pos+offWidth]),
+			Pos:    enc.Uint64(b[pos+offWidth : pos+entWidth]),
+		})
+	}
+	return entries, nil
+}
+
+// validEntries returns the leading entries that were written by appends to a
+// store of storeBytes bytes. The segment writes relative offsets 0, 1, 2...
+// at increasing positions, so the first entry whose offset doesn't match its
+// place in the index, or whose position doesn't advance past the previous
+// entry's, marks the end. A zeroed entry looks just like the first record's,
+// so it's only taken for one if the store isn't empty.
+func validEntries(entries []IndexEntry, storeBytes uint64) []IndexEntry {
+	for i, e := range entries {
+		if uint64(e.Offset) != uint64(i) ||
+			i == 0 && storeBytes == 0 ||
+			i > 0 && e.Pos <= entries[i-1].Pos {
+			return entries[:i]
+		}
+	}
+	return entries
+}
+
+// readFrame reads the length-prefixed frame at pos in the store file f of the
+// given size.
+func readFrame(f io.ReaderAt, size, pos uint64) ([]byte, error) {
+	if pos+lenWidth > size {
+		return nil, fmt.Errorf("frame length at %d runs past end of store (%d bytes)", pos, size)
+	}
+	l := make([]byte, lenWidth)
+	_, err := f.ReadAt(l, int64(pos))
+	if err != nil {
+		return nil, err
+	}
+	n := enc.Uint64(l)
+	if n > size-pos-lenWidth {
+		return nil, fmt.Errorf("frame of %d bytes at %d runs past end of store (%d bytes)", n, pos, size)
+	}
+	b := make([]byte, n)
+	_, err = f.ReadAt(b, int64(pos+lenWidth))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readRecord reads and decodes the frame at pos, decrypting it with keys if
+// it's encrypted, and checks that it holds the record with the offset the
+// index says it does.
+func readRecord(f io.ReaderAt, keys *Keyring, size, pos, off uint64) (*api.Record, error) {
+	p, err := readFrame(f, size, pos)
+	if err != nil {
+		return nil, err
+	}
+	p, err = decodeFrame(keys, p)
+	if err != nil {
+		return nil, fmt.Errorf("frame at %d: %v", pos, err)
+	}
+	record := &api.Record{}
+	err = proto.Unmarshal(p, record)
+	if err != nil {
+		return nil, fmt.Errorf("frame at %d: %v", pos, err)
+	}
+	if record.Offset != off {
+		return nil, fmt.Errorf("frame at %d holds offset %d, want %d", pos, record.Offset, off)
+	}
+	return record, nil
+}
+
+// ReadRecords calls fn with each record in dir whose offset is in [from, to],
+// in order. keys decrypts encrypted segments and may be nil if there are none.
+func ReadRecords(dir string, keys *Keyring, from, to uint64, fn func(*api.Record) error) error {
+	segments, err := InspectDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s.NextOffset <= from || to < s.BaseOffset {
+			continue
+		}
+		err = s.eachRecord(keys, func(off uint64, record *api.Record) error {
+			if off < from || to < off {
+				return nil
+			}
+			return fn(record)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachRecord calls fn with each indexed record in the segment.
+func (s SegmentInfo) eachRecord(keys *Keyring, fn func(off uint64, record *api.Record) error) error {
+	entries, err := ReadIndexEntries(s.IndexPath())
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(s.StorePath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for i, e := range validEntries(entries, s.StoreBytes) {
+		off := s.BaseOffset + uint64(i)
+		record, err := readRecord(f, keys, s.StoreBytes, e.Pos, off)
+		if err != nil {
+			return fmt.Errorf("segment %d: %v", s.BaseOffset, err)
+		}
+		err = fn(off, record)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Problem is an inconsistency found while verifying a segment.
+type Problem struct {
+	Segment uint64 `json:"segment"`
+	Offset  uint64 `json:"offset"`
+	Err     string `json:"error"`
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("segment %d offset %d: %s", p.Segment, p.Offset, p.Err)
+}
+
+// Verify checks that every index entry in dir points at a decodable store
+// frame holding the record for the entry's offset. keys decrypts encrypted
+// segments and may be nil if there are none.
+func Verify(dir string, keys *Keyring) ([]Problem, error) {
+	segments, err := InspectDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var problems []Problem
+	for _, s := range segments {
+		entries, err := ReadIndexEntries(s.IndexPath())
+		if err != nil {
+			problems = append(problems, Problem{Segment: s.BaseOffset, Offset: s.BaseOffset, Err: err.Error()})
+			continue
+		}
+		f, err := os.Open(s.StorePath())
+		if err != nil {
+			return nil, err
+		}
+		valid := validEntries(entries, s.StoreBytes)
+		for i, e := range valid {
+			off := s.BaseOffset + uint64(i)
+			_, err := readRecord(f, keys, s.StoreBytes, e.Pos, off)
+			if err != nil {
+				problems = append(problems, Problem{Segment: s.BaseOffset, Offset: off, Err: err.Error()})
+			}
+		}
+		f.Close()
+		// zeroed entries past the valid ones are expected, anything else
+		// means the index was overwritten
+		for i := len(valid); i < len(entries); i++ {
+			if entries[i] != (IndexEntry{}) {
+				problems = append(problems, Problem{
+					Segment: s.BaseOffset,
+					Offset:  s.BaseOffset + uint64(i),
+					Err:     fmt.Sprintf("index entry %d has offset %d", i, entries[i].Offset),
+				})
+				break
+			}
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,96 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspect-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	// leave the active segment's index zero-padded, as after a crash, but
+	// flush its store so the records are on disk
+	require.NoError(t, l.activeSegment.Sync())
+
+	segments, err := InspectDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(segments))
+	require.Equal(t, uint64(0), segments[0].BaseOffset)
+	require.Equal(t, uint64(2), segments[0].NextOffset)
+	require.Equal(t, uint64(2), segments[1].BaseOffset)
+	require.Equal(t, uint64(3), segments[1].NextOffset)
+	require.Equal(t, l.Config.Segment.MaxIndexBytes, segments[1].IndexBytes)
+
+	var offs []uint64
+	err = ReadRecords(dir, nil, 1, 2, func(record *api.Record) error {
+		require.Equal(t, []byte("hello world"), record.Value)
+		offs = append(offs, record.Offset)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2}, offs)
+
+	problems, err := Verify(dir, nil)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	// point the second index entry of the first segment at the first frame
+	entries, err := ReadIndexEntries(segments[0].IndexPath())
+	require.NoError(t, err)
+	f, err := os.OpenFile(segments[0].IndexPath(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	b := make([]byte, entWidth)
+	enc.PutUint32(b, 1)
+	enc.PutUint64(b[offWidth:], entries[0].Pos)
+	_, err = f.WriteAt(b, int64(entWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	problems, err = Verify(dir, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(problems))
+	require.Equal(t, uint64(1), problems[0].Offset)
+}
+
+func TestInspectEmptyActive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inspect-empty-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// the new active segment's index is all zeroed padding, none of which is
+	// a record
+	segments, err := InspectDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(segments))
+	require.Equal(t, uint64(0), segments[0].Entries)
+	require.Equal(t, uint64(0), segments[0].NextOffset)
+	problems, err := Verify(dir, nil)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	report, err := Check(dir, CheckOptions{})
+	require.NoError(t, err)
+	for _, issue := range report.Issues {
+		require.NotEqual(t, IssueIndexAhead, issue.Kind)
+	}
+}
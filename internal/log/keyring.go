@@ -0,0 +1,237 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const keySize = 32
+
+// encryptedFrame is the first byte of an encrypted frame. Protobuf never
+// starts a message with a zero byte, so plaintext frames stay readable.
+const encryptedFrame = 0x00
+
+var (
+	// ErrNoKeyring is returned when reading an encrypted frame without a
+	// keyring.
+	ErrNoKeyring = errors.New("frame is encrypted but no keyring was given")
+	// ErrUnknownKey is returned when reading a frame encrypted with a key
+	// that isn't in the keyring.
+	ErrUnknownKey = errors.New("frame is encrypted with an unknown key")
+	// ErrNotEncrypted is returned when rotating or re-encrypting a log
+	// without a keyring.
+	ErrNotEncrypted = errors.New("log isn't encrypted")
+)
+
+// Keyring holds the AES-256 keys that segments are encrypted with, persisted
+// in a JSON file. New segments are encrypted with the active key; frames name
+// the key they were encrypted with, so old keys stay readable until
+// Log.Reencrypt has rewritten the segments that use them.
+type Keyring struct {
+	mu     sync.RWMutex
+	path   string
+	active string
+	keys   map[string]cipher.AEAD
+	raw    map[string][]byte
+}
+
+type keyringFile struct {
+	Active string            `json:"active"`
+	Keys   map[string][]byte `json:"keys"`
+}
+
+func newKeyring(path string) *Keyring {
+	return &Keyring{
+		path: path,
+		keys: make(map[string]cipher.AEAD),
+		raw:  make(map[string][]byte),
+	}
+}
+
+// CreateKeyring creates a keyring at path holding a fresh active key.
+func CreateKeyring(path string) (*Keyring, error) {
+	k := newKeyring(path)
+	_, err := k.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// OpenKeyring loads the keyring at path.
+func OpenKeyring(path string) (*Keyring, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k := newKeyring(path)
+	var f keyringFile
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, fmt.Errorf("keyring %s: %v", path, err)
+	}
+	for id, key := range f.Keys {
+		err = k.add(id, key)
+		if err != nil {
+			return nil, fmt.Errorf("keyring %s: key %s: %v", path, id, err)
+		}
+	}
+	if _, ok := k.keys[f.Active]; !ok {
+		return nil, fmt.Errorf("keyring %s: active key %q isn't in the keyring", path, f.Active)
+	}
+	k.active = f.Active
+	return k, nil
+}
+
+func (k *Keyring) add(id string, key []byte) error {
+	if len(id) == 0 || len(id) > 255 {
+		return fmt.Errorf("key IDs must be 1 to 255 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = aead
+	k.raw[id] = key
+	return nil
+}
+
+// Rotate adds a new random key, makes it the active key and saves the
+// keyring. Segments created from then on are encrypted with it.
+func (k *Keyring) Rotate() (string, error) {
+	key := make([]byte, keySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return "", err
+	}
+	idb := make([]byte, 8)
+	_, err = io.ReadFull(rand.Reader, idb)
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idb)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	err = k.add(id, key)
+	if err != nil {
+		return "", err
+	}
+	prev := k.active
+	k.active = id
+	err = k.save()
+	if err != nil {
+		k.active = prev
+		delete(k.keys, id)
+		delete(k.raw, id)
+		return "", err
+	}
+	return id, nil
+}
+
+// Active returns the ID of the key new segments are encrypted with.
+func (k *Keyring) Active() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// save writes the keyring to a temporary file readable only by its owner
+// and renames it over the keyring, so a crash never leaves it half written.
+func (k *Keyring) save() error {
+	b, err := json.MarshalIndent(keyringFile{Active: k.active, Keys: k.raw}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
+
+// has reports whether the keyring, which may be nil, holds the key id.
+func (k *Keyring) has(id string) bool {
+	if k == nil {
+		return false
+	}
+	_, err := k.aead(id)
+	return err == nil
+}
+
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	return aead, nil
+}
+
+// encrypt seals p with the key id. The frame's header, which names the key,
+// is authenticated along with p.
+func (k *Keyring) encrypt(id string, p []byte) ([]byte, error) {
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte{encryptedFrame, byte(len(id))}, id...)
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(header)+len(nonce)+len(p)+aead.Overhead())
+	b = append(b, header...)
+	b = append(b, nonce...)
+	return aead.Seal(b, nonce, p, header), nil
+}
+
+// frameKey returns the ID of the key the frame p is encrypted with, or "" if
+// it's plaintext.
+func frameKey(p []byte) (string, error) {
+	if len(p) == 0 || p[0] != encryptedFrame {
+		return "", nil
+	}
+	if len(p) < 2 || len(p) < 2+int(p[1]) {
+		return "", fmt.Errorf("encrypted frame header cut short")
+	}
+	return string(p[2 : 2+int(p[1])]), nil
+}
+
+// decodeFrame returns the plaintext of the frame p, decrypting it with keys
+// if it's encrypted.
+func decodeFrame(keys *Keyring, p []byte) ([]byte, error) {
+	id, err := frameKey(p)
+	if err != nil || id == "" {
+		return p, err
+	}
+	if keys == nil {
+		return nil, ErrNoKeyring
+	}
+	aead, err := keys.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	header := p[:2+len(id)]
+	rest := p[len(header):]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted frame cut short")
+	}
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+}
@@ -0,0 +1,171 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+
+	// start with a plaintext segment, which Reencrypt encrypts
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	plain, err := NewLog(logDir, c)
+	require.NoError(t, err)
+	_, err = plain.Append(&api.Record{Value: []byte("plaintext 0")})
+	require.NoError(t, err)
+	require.NoError(t, plain.Close())
+
+	keys, err := CreateKeyring(path.Join(dir, "keyring.json"))
+	require.NoError(t, err)
+	first := keys.Active()
+	c.Encryption.Keyring = keys
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	appendN := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("secret %d", i))})
+			require.NoError(t, err)
+		}
+	}
+	appendN(3)
+	second, err := log.RotateKey()
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+	appendN(3)
+
+	// the rotated keyring is saved, and nothing's stored in plaintext once
+	// the segments using the first key are re-encrypted
+	keys, err = OpenKeyring(path.Join(dir, "keyring.json"))
+	require.NoError(t, err)
+	require.Equal(t, second, keys.Active())
+	n, err := log.Reencrypt()
+	require.NoError(t, err)
+	require.True(t, n > 0)
+	n, err = log.Reencrypt()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	segments, err := InspectDir(logDir)
+	require.NoError(t, err)
+	for _, s := range segments[:len(segments)-1] {
+		b, err := ioutil.ReadFile(s.StorePath())
+		require.NoError(t, err)
+		require.False(t, bytes.Contains(b, []byte("secret")))
+		require.False(t, bytes.Contains(b, []byte("plaintext")))
+		for pos := uint64(0); pos < uint64(len(b)); {
+			p, err := readFrame(bytes.NewReader(b), uint64(len(b)), pos)
+			require.NoError(t, err)
+			id, err := frameKey(p)
+			require.NoError(t, err)
+			require.Equal(t, second, id)
+			pos += lenWidth + uint64(len(p))
+		}
+	}
+
+	// records read back the same, before and after reopening
+	check := func(log *Log) {
+		record, err := log.Read(0)
+		require.NoError(t, err)
+		require.Equal(t, []byte("plaintext 0"), record.Value)
+		for off := uint64(1); off < 7; off++ {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, []byte(fmt.Sprintf("secret %d", (off-1)%3)), record.Value)
+		}
+	}
+	check(log)
+	// raw frames are sent decrypted
+	frames, err := log.ReadFrames(0, 7)
+	require.NoError(t, err)
+	_, ok := frames.Size()
+	require.False(t, ok)
+	var buf bytes.Buffer
+	_, err = frames.WriteTo(&buf)
+	require.NoError(t, err)
+	require.NoError(t, frames.Close())
+	require.Equal(t, 6, bytes.Count(buf.Bytes(), []byte("secret")))
+	require.NoError(t, log.Close())
+	log, err = NewLog(logDir, c)
+	require.NoError(t, err)
+	check(log)
+	require.NoError(t, log.Close())
+
+	// the offline tools need the keyring to read encrypted records
+	problems, err := Verify(logDir, keys)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+	problems, err = Verify(logDir, nil)
+	require.NoError(t, err)
+	require.NotEmpty(t, problems)
+	report, err := Check(logDir, CheckOptions{Keyring: keys})
+	require.NoError(t, err)
+	require.True(t, report.Clean())
+	report, err = Check(logDir, CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, report.Clean())
+
+	// without the keyring, the encrypted records can't be read
+	c.Encryption.Keyring = nil
+	log, err = NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	_, err = log.Read(1)
+	require.True(t, errors.Is(err, ErrNoKeyring), "%v", err)
+}
+
+func TestReencryptTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reencrypt-truncated-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keys, err := CreateKeyring(path.Join(dir, "keyring.json"))
+	require.NoError(t, err)
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Encryption.Keyring = keys
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("secret %d", i))})
+		require.NoError(t, err)
+	}
+	keyID, err := log.RotateKey()
+	require.NoError(t, err)
+
+	// a segment rewritten before a truncation isn't swapped in after it, even
+	// if the truncation left it sealed
+	require.True(t, len(log.segments) > 2)
+	s := log.segments[0]
+	ok, truncations, err := log.rewriteSegment(s, keyID)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, log.TruncateAfter(log.segments[1].baseOffset))
+	require.NotEqual(t, s, log.activeSegment)
+	ok, err = log.swapSegment(s, truncations)
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = os.Stat(s.store.Name() + reencryptExt)
+	require.True(t, os.IsNotExist(err))
+	record, err := log.Read(s.baseOffset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret 0"), record.Value)
+}
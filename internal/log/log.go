@@ -3,13 +3,12 @@ package log
 import (
 	"fmt"
 	"io/ioutil"
-	"path"
-	"sort"
-	"strconv"
-	"strings"
+	"os"
 	"sync"
+	"time"
 
 	api "github.com/andrwkng/proglog/api/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Log consisits of a list of segments
@@ -21,6 +20,38 @@ type Log struct {
 
 	activeSegment *segment // pointer to the active segment to append writes to`
 	segments      []*segment
+	closed        bool
+	// appended is closed and replaced after every append, waking up readers
+	// waiting for new records
+	appended chan struct{}
+	// producers holds the idempotent producers' latest appends by ID
+	producers map[string]*producerState
+	// openTxns holds open transactions' begin markers and abortedTxns the
+	// offsets of aborted transactions, both by ID
+	openTxns    map[string]openTxn
+	abortedTxns map[string][]offsetRange
+	// remote holds the segments uploaded to the tiering's blob store, local
+	// or not, oldest first, and cache the ones fetched back from it
+	remote []remoteSegment
+	cache  *segmentCache
+	// truncations counts TruncateAfter's calls, so uploads can tell if the
+	// segment they copied was truncated in the meantime
+	truncations uint64
+	// commits queues appends for the group committer, if group commit is
+	// configured, and committed is closed once it's stopped. queued holds
+	// AppendAsync's appends, inFlight limits how many are outstanding and
+	// asyncDone is closed once they've all been committed. quit stops both.
+	// batches counts the batches they've committed.
+	commits     chan *appendRequest
+	committed   chan struct{}
+	asyncMu     sync.Mutex
+	asyncClosed bool
+	queued      chan *appendRequest
+	inFlight    chan struct{}
+	asyncDone   chan struct{}
+	quit        chan struct{}
+	quitOnce    sync.Once
+	batches     int
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -31,67 +62,210 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Segment.MaxRecordBytes == 0 {
+		c.Segment.MaxRecordBytes = c.Segment.MaxStoreBytes
+	}
+	if c.Segment.MaxRecordBytes > c.Segment.MaxStoreBytes {
+		return nil, fmt.Errorf("max record bytes %d exceeds max store bytes %d",
+			c.Segment.MaxRecordBytes, c.Segment.MaxStoreBytes)
+	}
+	if c.Async.MaxInFlight == 0 {
+		c.Async.MaxInFlight = 64
+	}
+	if c.Transactions.Timeout == 0 {
+		c.Transactions.Timeout = time.Minute
+	}
 
 	// create a log instance and setup the instance
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:      dir,
+		Config:   c,
+		appended: make(chan struct{}),
+	}
+	err := l.setup()
+	if err != nil {
+		return nil, err
 	}
-	return l, l.setup()
+	l.quit = make(chan struct{})
+	if c.Durability.MaxBatch > 1 {
+		l.commits = make(chan *appendRequest)
+		l.committed = make(chan struct{})
+		go l.groupCommit()
+	}
+	l.queued = make(chan *appendRequest, c.Async.MaxInFlight)
+	l.inFlight = make(chan struct{}, c.Async.MaxInFlight)
+	l.asyncDone = make(chan struct{})
+	go l.asyncCommit()
+	go l.expireTxns()
+	return l, nil
 }
 
 // Append appends a record to the log. We append the record to the active segment.
 // Afterward, if the segment is at its max size (per the max size configs),
-// then we make a new active segment.
+// then we make a new active segment. The record's append time is set to now.
+//
+// A record with a producer ID whose sequence number the log has already
+// written isn't appended again; Append returns the offset it was written at.
+//
+// With group commit configured, concurrent appends are queued and written
+// together, covered by a single sync.
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	if l.commits != nil {
+		return l.groupAppend(record)
+	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrLogClosed
+	}
+	off, err := l.append(record)
+	if err != nil {
+		return off, err
+	}
+	if l.Config.Durability.SyncOnAppend {
+		err = l.activeSegment.Sync()
+	}
+	return off, err
+}
 
-	off, err := l.activeSegment.Append(record)
+// append writes the record to the active segment, rolling it if it's maxed,
+// but leaves syncing it to the caller. The log must be locked.
+func (l *Log) append(record *api.Record) (uint64, error) {
+	off, dup, err := l.dedup(record)
+	if err != nil {
+		return 0, err
+	}
+	if dup {
+		record.Offset = off
+		return off, nil
+	}
+	err = l.checkTxn(record)
 	if err != nil {
 		return 0, err
 	}
 
+	record.AppendTime = timestamppb.Now()
+	off, err = l.activeSegment.Append(record)
+	if err != nil {
+		return 0, err
+	}
+	l.trackProducer(record)
+	l.trackTxn(record)
+	close(l.appended)
+	l.appended = make(chan struct{})
+
 	if l.activeSegment.IsMaxed() {
+		// the segment won't be written to again, so get all of it onto disk
+		// where readers of the files, like InspectDir, can see it
+		err = l.activeSegment.Sync()
+		if err != nil {
+			return 0, err
+		}
 		err = l.newSegment(off + 1)
+		if err != nil {
+			return 0, err
+		}
+		err = l.saveState()
+		if err != nil {
+			return 0, err
+		}
+		err = l.retain()
 	}
 	return off, err
-
 }
 
 // Read reads the record stored at the given offset.
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	var s *segment
-	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
-		}
+	if l.closed {
+		return nil, ErrLogClosed
 	}
-	if s == nil || s.nextOffset <= off {
-		return nil, fmt.Errorf("offset out of range: %d", off)
+	return l.read(off)
+}
+
+func (l *Log) read(off uint64) (*api.Record, error) {
+	s := l.segmentFor(off)
+	if s == nil {
+		record, ok, err := l.readRemote(off)
+		if ok {
+			return record, err
+		}
+		return nil, l.outOfRange(off)
 	}
 	return s.Read(off)
 }
 
+// segmentFor returns the local segment holding off, or nil if there isn't one.
+func (l *Log) segmentFor(off uint64) *segment {
+	for _, s := range l.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return s
+		}
+	}
+	return nil
+}
+
+// Appended returns a channel that's closed once a record is appended after
+// the call. Readers that have caught up with the log get the channel before
+// reading the next offset and wait on it if the offset isn't there yet.
+func (l *Log) Appended() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.appended
+}
+
 // Close iterates over the segments and closes them
 func (l *Log) Close() error {
+	l.stopCommitters()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
 		}
 	}
-	return nil
+	return l.cache.Close()
+}
+
+// Writable returns nil if the log is open and new segment files can be created
+// in its directory, otherwise it returns the reason why appends would fail.
+func (l *Log) Writable() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	// probe the directory the same way a segment roll would, by creating a file
+	f, err := ioutil.TempFile(l.Dir, ".writable")
+	if err != nil {
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(f.Name())
 }
 
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	return l.segments[0].baseOffset, nil
+	return l.lowestOffset(), nil
+}
+
+// lowestOffset returns the base offset of the oldest segment, whether it's
+// local or only in the blob store.
+func (l *Log) lowestOffset() uint64 {
+	lowest := l.segments[0].baseOffset
+	if len(l.remote) > 0 && l.remote[0].BaseOffset < lowest {
+		lowest = l.remote[0].BaseOffset
+	}
+	return lowest
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
@@ -120,48 +294,242 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	for len(l.remote) > 0 && l.remote[0].NextOffset <= lowest+1 {
+		err := l.removeRemote(l.remote[0].BaseOffset)
+		if err != nil {
+			return err
+		}
+	}
+	l.pruneTxns()
+	l.pruneProducers()
+	return nil
+}
+
+// TruncateAfter removes the records after off, shrinking the segment that
+// holds off, which becomes the active segment, and removing the segments
+// after it along with their uploaded copies. It waits for reads to finish.
+// The shrunk store is written to a new file renamed over the old one, so
+// snapshots linked to it and Frames read beforehand keep the records they
+// held. The producer and transaction state is rebuilt from the newest
+// checkpoint that's left and the records after it.
+//
+// A crash between replacing the store and truncating its index leaves an
+// index that proglog-fsck -rebuild-index repairs.
+func (l *Log) TruncateAfter(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return ErrLogClosed
+	}
+	if off+1 >= l.activeSegment.nextOffset {
+		return nil
+	}
+	s := l.segmentFor(off)
+	if s == nil {
+		if _, ok := l.remoteFor(off); ok {
+			return fmt.Errorf("offset %d is only in the blob store", off)
+		}
+		return l.outOfRange(off)
+	}
+
+	var segments []*segment
+	for _, seg := range l.segments {
+		if seg.baseOffset <= off {
+			segments = append(segments, seg)
+			continue
+		}
+		err := seg.Remove()
+		if err != nil {
+			return err
+		}
+	}
+	l.segments = segments
+	for n := len(l.remote); n > 0 && l.remote[n-1].BaseOffset >= s.baseOffset; n = len(l.remote) {
+		// the segment's own upload holds the records being removed too
+		err := l.removeRemote(l.remote[n-1].BaseOffset)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.truncateAfter(off)
+	if err != nil {
+		return err
+	}
+	l.activeSegment = s
+	l.truncations++
+	err = l.loadState()
+	if err != nil {
+		return err
+	}
+	if s.IsMaxed() {
+		err = l.newSegment(off + 1)
+		if err != nil {
+			return err
+		}
+		return l.saveState()
+	}
 	return nil
 }
 
+// retain removes the oldest segments that fall outside the configured retention
+// limits, starting with uploaded segments that are no longer local. The active
+// segment is always kept.
+func (l *Log) retain() error {
+	var total uint64
+	for _, s := range l.segments {
+		total += s.store.size
+	}
+	for _, r := range l.remote {
+		if r.BaseOffset < l.segments[0].baseOffset {
+			total += r.StoreBytes
+		}
+	}
+	max := l.Config.Retention.MaxBytes
+	for len(l.remote) > 0 && l.remote[0].BaseOffset < l.segments[0].baseOffset {
+		r := l.remote[0]
+		maxAge := l.Config.Retention.MaxAge
+		expired := maxAge != 0 && time.Since(r.ModTime) > maxAge
+		if !expired && (max == 0 || total <= max) {
+			l.pruneTxns()
+			l.pruneProducers()
+			return nil
+		}
+		err := l.removeRemote(r.BaseOffset)
+		if err != nil {
+			return err
+		}
+		total -= r.StoreBytes
+	}
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		expired, err := l.expired(s)
+		if err != nil {
+			return err
+		}
+		if !expired && (max == 0 || total <= max) {
+			break
+		}
+		err = s.Remove()
+		if err != nil {
+			return err
+		}
+		err = l.removeRemote(s.baseOffset)
+		if err != nil {
+			return err
+		}
+		total -= s.store.size
+		l.segments = l.segments[1:]
+	}
+	l.pruneTxns()
+	l.pruneProducers()
+	return nil
+}
+
+// expired reports whether the segment was last written to longer ago than the
+// retention's max age.
+func (l *Log) expired(s *segment) (bool, error) {
+	if l.Config.Retention.MaxAge == 0 {
+		return false, nil
+	}
+	fi, err := os.Stat(s.store.Name())
+	if err != nil {
+		return false, err
+	}
+	return time.Since(fi.ModTime()) > l.Config.Retention.MaxAge, nil
+}
+
 // setup is responsible for setting the log up for the segments that
 // already exist on disk or, if the log is new and has no existing segments, for
 // bootstrapping the initial segment
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	err := l.loadTier()
 	if err != nil {
 		return err
 	}
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(
-			file.Name(),
-			path.Ext(file.Name()),
-		)
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		//
-		baseOffsets = append(baseOffsets, off)
+	baseOffsets, err := baseOffsets(l.Dir)
+	if err != nil {
+		return err
 	}
 
-	// sort the base offsets (because we want our slice of segments to be in order from oldest to newest)
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
-
 	// create the segments
-	for i := 0; i < len(baseOffsets); i++ {
-		err := l.newSegment(baseOffsets[i])
+	for _, off := range baseOffsets {
+		err := l.newSegment(off)
 		if err != nil {
 			return err
 		}
-		// baseOffset contains dup for index and store so we skip the dup
-		i++
 	}
 	//  if the log has no existing segments, bootstrap the initial segment
 	if l.segments == nil {
-		err := l.newSegment(l.Config.Segment.InitialOffset)
+		off := l.Config.Segment.InitialOffset
+		// carry on after the uploaded segments if the local ones are gone
+		if n := len(l.remote); n > 0 && l.remote[n-1].NextOffset > off {
+			off = l.remote[n-1].NextOffset
+		}
+		err := l.newSegment(off)
+		if err != nil {
+			return err
+		}
+	}
+	err = l.loadState()
+	if err != nil {
+		return err
+	}
+	return l.retain()
+}
+
+// loadState rebuilds the idempotent producers' and transactions' state, so it
+// survives restarts, from the newest segment's checkpoint and the records
+// after it. If no segment has a checkpoint, it reads every record in the log,
+// including those in uploaded segments that are no longer local.
+func (l *Log) loadState() error {
+	l.producers = make(map[string]*producerState)
+	l.openTxns = make(map[string]openTxn)
+	l.abortedTxns = make(map[string][]offsetRange)
+	for i := len(l.segments) - 1; i >= 0; i-- {
+		ok, err := l.loadCheckpoint(l.segments[i])
 		if err != nil {
 			return err
 		}
+		if ok {
+			err = l.replay(l.segments[i:])
+			if err != nil {
+				return err
+			}
+			// the checkpoint may remember producers whose records have
+			// since been removed
+			l.pruneProducers()
+			return nil
+		}
+	}
+
+	for _, r := range l.remote {
+		if r.BaseOffset >= l.segments[0].baseOffset {
+			break
+		}
+		for off := r.BaseOffset; off < r.NextOffset; off++ {
+			record, err := l.cache.read(r, off)
+			if err != nil {
+				return err
+			}
+			l.trackProducer(record)
+			l.trackTxn(record)
+		}
+	}
+	return l.replay(l.segments)
+}
+
+// replay updates the state with the segments' records.
+func (l *Log) replay(segments []*segment) error {
+	for _, s := range segments {
+		for off := s.baseOffset; off < s.nextOffset; off++ {
+			record, err := s.Read(off)
+			if err != nil {
+				return err
+			}
+			l.trackProducer(record)
+			l.trackTxn(record)
+		}
 	}
 	return nil
 }
@@ -170,6 +538,12 @@ func (l *Log) setup() error {
 // slice of segments, and makes the new segment the active segment so that
 // subsequent append calls write to it.
 func (l *Log) newSegment(off uint64) error {
+	if l.activeSegment != nil {
+		err := l.activeSegment.seal()
+		if err != nil {
+			return err
+		}
+	}
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
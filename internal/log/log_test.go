@@ -1,12 +1,18 @@
 package log
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	api "github.com/andrwkng/proglog/api/v1"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestLog(t *testing.T) {
@@ -17,13 +23,25 @@ func TestLog(t *testing.T) {
 		"offset out of range error":         testOutOfRangeErr,
 		"init with existing segments":       testInitExisting,
 		"truncate":                          testTruncate,
+		"writable until closed":             testWritable,
+		"sync on append":                    testSyncOnAppend,
+		"retention by size":                 testRetention,
+		"appended wakes waiting readers":    testAppended,
+		"record metadata survives reopen":   testRecordMetadata,
+		"idempotent producer retries":       testIdempotentProducer,
+		"read committed transactions":       testTransactions,
+		"transaction timeout":               testTxnTimeout,
+		"read raw frames":                   testReadFrames,
+		"record too large":                  testRecordTooLarge,
+		"corrupt record":                    testCorruptRecord,
+		"closed log errors":                 testClosedErr,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
 			require.NoError(t, err)
 			defer os.RemoveAll(dir)
 			c := Config{}
-			c.Segment.MaxStoreBytes = 32
+			c.Segment.MaxStoreBytes = 64
 			log, err := NewLog(dir, c)
 			require.NoError(t, err)
 			fn(t, log)
@@ -31,6 +49,108 @@ func TestLog(t *testing.T) {
 	}
 }
 
+func TestTruncateAfter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "truncate-after-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	record := func(seq uint64) *api.Record {
+		return &api.Record{
+			Value:      []byte(fmt.Sprintf("record %d", seq)),
+			ProducerId: "producer",
+			Sequence:   seq,
+		}
+	}
+	for i := uint64(0); i < 10; i++ {
+		_, err := log.Append(record(i))
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 2)
+
+	// a snapshot linked to the segment being truncated keeps its records
+	snapDir, err := ioutil.TempDir("", "truncate-after-snapshot")
+	require.NoError(t, err)
+	defer os.RemoveAll(snapDir)
+	require.NoError(t, os.Remove(snapDir))
+	snapshot, err := log.Snapshot(snapDir)
+	require.NoError(t, err)
+
+	// readers carry on while the log's truncated
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for off := uint64(0); off < 10; off++ {
+			_, err := log.Read(off)
+			if err != nil {
+				require.True(t, errors.Is(err, ErrOffsetOutOfRange), "%v", err)
+			}
+		}
+	}()
+	require.NoError(t, log.TruncateAfter(4))
+	<-done
+	require.NoError(t, log.TruncateAfter(4))
+
+	for _, s := range snapshot {
+		fi, err := os.Stat(s.StorePath())
+		require.NoError(t, err)
+		require.Equal(t, int64(s.StoreBytes), fi.Size())
+	}
+	problems, err := Verify(snapDir, nil)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	check := func(log *Log) {
+		highest, err := log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(4), highest)
+		for off := uint64(0); off <= 4; off++ {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", off)), read.Value)
+		}
+		_, err = log.Read(5)
+		var oor *OffsetOutOfRangeError
+		require.True(t, errors.As(err, &oor), "%v", err)
+		require.Equal(t, uint64(5), oor.Next)
+		s := log.activeSegment
+		require.Equal(t, uint64(5), s.nextOffset)
+		require.Equal(t, (s.nextOffset-s.baseOffset)*entWidth, s.index.size)
+		fi, err := os.Stat(s.store.Name())
+		require.NoError(t, err)
+		require.Equal(t, int64(s.store.size), fi.Size())
+	}
+	check(log)
+	baseOffsets, err := baseOffsets(dir)
+	require.NoError(t, err)
+	require.Equal(t, log.activeSegment.baseOffset, baseOffsets[len(baseOffsets)-1])
+
+	// the producer's state forgets the removed records, so a retry of one is
+	// out of order rather than a duplicate
+	_, err = log.Append(record(7))
+	require.True(t, errors.Is(err, ErrOutOfOrderSequence), "%v", err)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	check(log)
+	off, err := log.Append(record(5))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	read, err := log.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 5"), read.Value)
+
+	var oor *OffsetOutOfRangeError
+	require.NoError(t, log.Truncate(3))
+	require.True(t, errors.As(log.TruncateAfter(0), &oor))
+	require.NoError(t, log.Close())
+	require.True(t, errors.Is(log.TruncateAfter(4), ErrLogClosed))
+}
+
 func testAppendRead(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
@@ -47,7 +167,65 @@ func testAppendRead(t *testing.T, log *Log) {
 func testOutOfRangeErr(t *testing.T, log *Log) {
 	read, err := log.Read(1)
 	require.Nil(t, read)
+	require.True(t, errors.Is(err, ErrOffsetOutOfRange), "%v", err)
+	var oor *OffsetOutOfRangeError
+	require.True(t, errors.As(err, &oor))
+	require.Equal(t, OffsetOutOfRangeError{Offset: 1, Lowest: 0, Next: 0}, *oor)
+}
+
+func testRecordTooLarge(t *testing.T, log *Log) {
+	// the largest record defaults to the segments' store size
+	_, err := log.Append(&api.Record{Value: make([]byte, 64)})
+	require.True(t, errors.Is(err, ErrRecordTooLarge), "%v", err)
+	var tooLarge *RecordTooLargeError
+	require.True(t, errors.As(err, &tooLarge))
+	require.Equal(t, log.Config.Segment.MaxStoreBytes, tooLarge.Max)
+	require.True(t, tooLarge.Size > tooLarge.Max)
+
+	// and can't be larger
+	c := log.Config
+	c.Segment.MaxRecordBytes = c.Segment.MaxStoreBytes + 1
+	_, err = NewLog(log.Dir, c)
 	require.Error(t, err)
+
+	// nothing was written, so the next record gets the first offset
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+}
+
+func testCorruptRecord(t *testing.T, log *Log) {
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	// claim the first record is longer than its store
+	f, err := os.OpenFile(log.segments[0].store.Name(), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff, 0, 0, 0, 0, 0, 0, 0}, 0)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = log.Read(0)
+	require.True(t, errors.Is(err, ErrCorruptRecord), "%v", err)
+	var corrupt *CorruptRecordError
+	require.True(t, errors.As(err, &corrupt))
+	require.Equal(t, uint64(0), corrupt.Offset)
+	_, err = log.Read(1)
+	require.NoError(t, err)
+}
+
+func testClosedErr(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.True(t, errors.Is(err, ErrLogClosed), "%v", err)
+	_, err = log.Read(0)
+	require.True(t, errors.Is(err, ErrLogClosed), "%v", err)
+	_, _, err = log.Scan(0, 1, ReadUncommitted)
+	require.True(t, errors.Is(err, ErrLogClosed), "%v", err)
+	require.True(t, errors.Is(log.Writable(), ErrLogClosed))
 }
 
 // testInitExisting tests that when we create a log, the log bootstraps
@@ -98,3 +276,289 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+// testWritable tests that the log reports itself writable while open and
+// stops doing so once closed.
+func testWritable(t *testing.T, log *Log) {
+	require.NoError(t, log.Writable())
+	require.NoError(t, log.Close())
+	require.Error(t, log.Writable())
+}
+
+// testSyncOnAppend tests that appends reach the store file before the log is
+// closed when configured to sync on every append.
+func testSyncOnAppend(t *testing.T, log *Log) {
+	log.Config.Durability.SyncOnAppend = true
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	fi, err := os.Stat(log.activeSegment.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(log.activeSegment.store.size), fi.Size())
+}
+
+// testRetention tests that the oldest segments are removed once the log
+// outgrows its retention limit.
+func testRetention(t *testing.T, log *Log) {
+	log.Config.Retention.MaxBytes = 64
+	_, err := log.Append(&api.Record{Value: []byte("produced"), ProducerId: "p"})
+	require.NoError(t, err)
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.True(t, off > 0)
+	_, err = log.Read(0)
+	require.Error(t, err)
+	_, err = log.Read(6)
+	require.NoError(t, err)
+
+	// the producer's only record was removed, so it's forgotten without
+	// reopening the log
+	log.mu.RLock()
+	_, ok := log.producers["p"]
+	log.mu.RUnlock()
+	require.False(t, ok)
+}
+
+// testAppended tests that readers waiting on Appended are woken by the next
+// append and not before.
+func testAppended(t *testing.T, log *Log) {
+	appended := log.Appended()
+	select {
+	case <-appended:
+		t.Fatal("appended closed before an append")
+	default:
+	}
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	<-appended
+
+	select {
+	case <-log.Appended():
+		t.Fatal("appended closed by an earlier append")
+	default:
+	}
+}
+
+// testRecordMetadata tests that a record's key, timestamps and headers are
+// stored with it and that the log stamps its append time.
+func testRecordMetadata(t *testing.T, log *Log) {
+	// the record's metadata makes it larger than the scenarios' segments
+	require.NoError(t, log.Close())
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+
+	produced := time.Now().Add(-time.Minute)
+	record := &api.Record{
+		Value:       []byte("hello world"),
+		Key:         []byte("user-1"),
+		ProduceTime: timestamppb.New(produced),
+		Headers:     map[string]string{"content-type": "text/plain", "trace-id": "abc"},
+	}
+	before := time.Now()
+	off, err := log.Append(record)
+	require.NoError(t, err)
+	require.NotNil(t, record.AppendTime)
+	require.False(t, record.AppendTime.AsTime().Before(before.Truncate(time.Microsecond)))
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.True(t, proto.Equal(record, read), "%v != %v", record, read)
+	require.True(t, read.ProduceTime.AsTime().Equal(produced))
+}
+
+// testIdempotentProducer tests that a producer's retried sequence numbers get
+// their original offsets, before and after the log is reopened, and that
+// skipped or forgotten sequence numbers are rejected.
+func testIdempotentProducer(t *testing.T, log *Log) {
+	produce := func(producer string, seq uint64) (uint64, error) {
+		return log.Append(&api.Record{
+			Value:      []byte("hello world"),
+			ProducerId: producer,
+			Sequence:   seq,
+		})
+	}
+
+	for seq := uint64(0); seq < 3; seq++ {
+		off, err := produce("a", seq)
+		require.NoError(t, err)
+		require.Equal(t, seq, off)
+	}
+	off, err := produce("b", 7)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	off, err = produce("a", 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	_, err = produce("a", 4)
+	require.True(t, errors.Is(err, ErrOutOfOrderSequence))
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+
+	off, err = produce("a", 2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	off, err = produce("b", 7)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	off, err = produce("a", 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	for seq := uint64(4); seq < 4+producerWindow; seq++ {
+		_, err = produce("a", seq)
+		require.NoError(t, err)
+	}
+	_, err = produce("a", 0)
+	require.True(t, errors.Is(err, ErrStaleSequence))
+}
+
+// testTransactions tests that read-committed scans see committed transactions'
+// records, skip aborted ones and stop at open ones, before and after the log is
+// reopened.
+func testTransactions(t *testing.T, log *Log) {
+	appendValue := func(txn, value string) {
+		_, err := log.Append(&api.Record{Value: []byte(value), TransactionId: txn})
+		require.NoError(t, err)
+	}
+	scan := func(isolation Isolation) []string {
+		records, _, err := log.Scan(0, 100, isolation)
+		require.NoError(t, err)
+		var values []string
+		for _, record := range records {
+			values = append(values, string(record.Value))
+		}
+		return values
+	}
+
+	_, err := log.Begin("a")
+	require.NoError(t, err)
+	_, err = log.Begin("a")
+	require.True(t, errors.Is(err, ErrTransactionOpen))
+	appendValue("a", "a1")
+	appendValue("", "plain")
+	b, err := log.Begin("b")
+	require.NoError(t, err)
+	appendValue("b", "b1")
+	appendValue("a", "a2")
+	_, err = log.Commit("a")
+	require.NoError(t, err)
+	_, err = log.Commit("a")
+	require.True(t, errors.Is(err, ErrTransactionNotOpen))
+	_, err = log.Append(&api.Record{Value: []byte("late"), TransactionId: "a"})
+	require.True(t, errors.Is(err, ErrTransactionNotOpen))
+
+	// b is still open, so read-committed consumers stop at its begin marker
+	require.Equal(t, b, log.LastStableOffset())
+	require.Equal(t, []string{"a1", "plain"}, scan(ReadCommitted))
+	require.Equal(t, []string{"a1", "plain", "b1", "a2"}, scan(ReadUncommitted))
+	_, err = log.ReadIsolated(b+1, ReadCommitted)
+	require.True(t, errors.Is(err, ErrNotCommitted))
+	record, err := log.ReadIsolated(b+1, ReadUncommitted)
+	require.NoError(t, err)
+	require.Equal(t, "b1", string(record.Value))
+
+	_, err = log.Abort("b")
+	require.NoError(t, err)
+	appendValue("", "after")
+	require.Equal(t, []string{"a1", "plain", "a2", "after"}, scan(ReadCommitted))
+
+	// reading committed leaves out the same records as scanning does
+	for off, value := range []string{"", "a1", "plain", "", "", "a2", "", "", "after"} {
+		record, err := log.ReadIsolated(uint64(off), ReadCommitted)
+		if value == "" {
+			require.True(t, errors.Is(err, ErrNotCommitted), "offset %d", off)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, value, string(record.Value))
+	}
+
+	_, err = log.Begin("c")
+	require.NoError(t, err)
+	appendValue("c", "c1")
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, []string{"a1", "plain", "a2", "after"}, scan(ReadCommitted))
+	_, err = log.Commit("c")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a1", "plain", "a2", "after", "c1"}, scan(ReadCommitted))
+	require.Equal(t, log.activeSegment.nextOffset, log.LastStableOffset())
+}
+
+// testTxnTimeout tests that transactions left open past the timeout are
+// aborted, releasing the last stable offset.
+func testTxnTimeout(t *testing.T, log *Log) {
+	_, err := log.Begin("a")
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("a1"), TransactionId: "a"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), log.LastStableOffset())
+
+	n, err := log.abortExpired(time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	n, err = log.abortExpired(time.Now().Add(log.Config.Transactions.Timeout + time.Second))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	require.Equal(t, uint64(3), log.LastStableOffset())
+	records, _, err := log.Scan(0, 10, ReadCommitted)
+	require.NoError(t, err)
+	require.Empty(t, records)
+	_, err = log.Commit("a")
+	require.True(t, errors.Is(err, ErrTransactionNotOpen))
+}
+
+func testReadFrames(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	frames, err := log.ReadFrames(1, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), frames.NextOffset)
+	size, ok := frames.Size()
+	require.True(t, ok)
+	// frames read before a truncate keep their records
+	require.NoError(t, log.TruncateAfter(1))
+	var buf bytes.Buffer
+	n, err := frames.WriteTo(&buf)
+	require.NoError(t, err)
+	require.NoError(t, frames.Close())
+	require.Equal(t, int64(size), n)
+	b := buf.Bytes()
+	for off := uint64(1); off < 4; off++ {
+		n := enc.Uint64(b[:lenWidth])
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+n], record))
+		require.Equal(t, off, record.Offset)
+		b = b[lenWidth+n:]
+	}
+	require.Empty(t, b)
+
+	frames, err = log.ReadFrames(2, 10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), frames.NextOffset)
+	require.NoError(t, frames.Close())
+}
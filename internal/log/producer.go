@@ -0,0 +1,94 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+
+	api "github.com/andrwkng/proglog/api/v1"
+)
+
+// producerWindow is how many of a producer's latest appends the log remembers,
+// and so how far behind a retry can be and still get its original offset.
+const producerWindow = 5
+
+var (
+	// ErrOutOfOrderSequence is returned when a producer skips a sequence
+	// number, meaning a record it sent before was lost.
+	ErrOutOfOrderSequence = errors.New("out of order sequence number")
+	// ErrStaleSequence is returned when a producer retries a sequence number
+	// too old for the log to remember the offset it was written at.
+	ErrStaleSequence = errors.New("sequence number too old to deduplicate")
+)
+
+// producerAppend is a producer's record the log has written.
+type producerAppend struct {
+	sequence uint64
+	offset   uint64
+}
+
+// producerState holds a producer's latest appends, oldest first.
+type producerState struct {
+	appends []producerAppend
+}
+
+// dedup checks the record's sequence number against its producer's earlier
+// appends. If the record has been written before it returns the offset it was
+// written at and true. Records without a producer ID are never duplicates.
+func (l *Log) dedup(record *api.Record) (uint64, bool, error) {
+	if record.ProducerId == "" {
+		return 0, false, nil
+	}
+	p, ok := l.producers[record.ProducerId]
+	if !ok {
+		// new producers, or those whose records have all been removed, may
+		// start from any sequence number
+		return 0, false, nil
+	}
+	last := p.appends[len(p.appends)-1].sequence
+	switch {
+	case record.Sequence == last+1:
+		return 0, false, nil
+	case record.Sequence > last+1:
+		return 0, false, fmt.Errorf("producer %s: %w: got %d, want %d",
+			record.ProducerId, ErrOutOfOrderSequence, record.Sequence, last+1)
+	}
+	for _, a := range p.appends {
+		if a.sequence == record.Sequence {
+			return a.offset, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("producer %s: %w: %d", record.ProducerId, ErrStaleSequence, record.Sequence)
+}
+
+// trackProducer records that the record was appended at its offset.
+func (l *Log) trackProducer(record *api.Record) {
+	if record.ProducerId == "" {
+		return
+	}
+	p, ok := l.producers[record.ProducerId]
+	if !ok {
+		p = &producerState{}
+		l.producers[record.ProducerId] = p
+	}
+	p.appends = append(p.appends, producerAppend{
+		sequence: record.Sequence,
+		offset:   record.Offset,
+	})
+	if len(p.appends) > producerWindow {
+		p.appends = p.appends[1:]
+	}
+}
+
+// pruneProducers forgets the producers whose records have all been removed
+// from the log, so they may start again from any sequence number.
+func (l *Log) pruneProducers() {
+	if len(l.segments) == 0 {
+		return
+	}
+	lowest := l.lowestOffset()
+	for id, p := range l.producers {
+		if p.appends[len(p.appends)-1].offset < lowest {
+			delete(l.producers, id)
+		}
+	}
+}
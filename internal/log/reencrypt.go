@@ -0,0 +1,219 @@
+package log
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// reencryptExt is the extension of the files Reencrypt writes a segment's
+// rewritten store and index to before swapping them in.
+const reencryptExt = ".reencrypt"
+
+// RotateKey makes a new key the keyring's active key, returning its ID. The
+// segments created from then on are encrypted with it.
+func (l *Log) RotateKey() (string, error) {
+	keys := l.Config.Encryption.Keyring
+	if keys == nil {
+		return "", ErrNotEncrypted
+	}
+	return keys.Rotate()
+}
+
+// Reencrypt rewrites the sealed segments holding frames that aren't encrypted
+// with the keyring's active key, including plaintext frames, and returns how
+// many it rewrote. Segments are rewritten without holding the log's lock and
+// swapped in under it, so it can run in the background while the log's in use.
+//
+// A crash between renaming a segment's store and its index into place leaves
+// an index that proglog-fsck -rebuild-index repairs.
+func (l *Log) Reencrypt() (int, error) {
+	keys := l.Config.Encryption.Keyring
+	if keys == nil {
+		return 0, ErrNotEncrypted
+	}
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return 0, ErrLogClosed
+	}
+	sealed := make([]*segment, len(l.segments)-1)
+	copy(sealed, l.segments)
+	l.mu.RUnlock()
+
+	var n int
+	for _, s := range sealed {
+		keyID := keys.Active()
+		ok, truncations, err := l.rewriteSegment(s, keyID)
+		if err != nil {
+			return n, fmt.Errorf("segment %d: %v", s.baseOffset, err)
+		}
+		if !ok {
+			continue
+		}
+		ok, err = l.swapSegment(s, truncations)
+		if err != nil {
+			return n, fmt.Errorf("segment %d: %v", s.baseOffset, err)
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// rewriteSegment writes the sealed segment's frames, encrypted with keyID, to
+// new store and index files next to its own, and returns the log's
+// truncation count from when it read the segment. It returns false without
+// writing anything if every frame is already encrypted with keyID, or the
+// segment has been removed.
+func (l *Log) rewriteSegment(s *segment, keyID string) (bool, uint64, error) {
+	keys := l.Config.Encryption.Keyring
+	// read the segment's size under the lock, so it can't be truncated while
+	// we do; the store we open keeps those records even if it's truncated
+	// afterwards, which swapSegment checks for
+	l.mu.RLock()
+	storeName := s.store.Name()
+	indexName := s.index.Name()
+	size := s.store.size
+	entries := s.nextOffset - s.baseOffset
+	truncations := l.truncations
+	f, err := os.Open(storeName)
+	l.mu.RUnlock()
+	if os.IsNotExist(err) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	defer f.Close()
+	ok, err := rewriteStore(f, size, entries, keys, keyID, storeName, indexName)
+	return ok, truncations, err
+}
+
+// rewriteStore writes the first size bytes of the store f, holding entries
+// frames, encrypted with keyID to storeName and indexName with the reencrypt
+// extension. It returns false without writing anything if every frame is
+// already encrypted with keyID.
+func rewriteStore(f *os.File, size, entries uint64, keys *Keyring, keyID, storeName, indexName string) (bool, error) {
+	var stale bool
+	var frames uint64
+	for pos := uint64(0); pos < size; frames++ {
+		p, err := readFrame(f, size, pos)
+		if err != nil {
+			return false, err
+		}
+		id, err := frameKey(p)
+		if err != nil {
+			return false, fmt.Errorf("frame at %d: %v", pos, err)
+		}
+		stale = stale || id != keyID
+		pos += lenWidth + uint64(len(p))
+	}
+	if !stale {
+		return false, nil
+	}
+	if frames != entries {
+		return false, fmt.Errorf("store holds %d frames but the index %d entries; run proglog-fsck",
+			frames, entries)
+	}
+
+	name := storeName + reencryptExt
+	out, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return false, err
+	}
+	defer out.Close()
+	buf := bufio.NewWriter(out)
+	written := make([]IndexEntry, 0, frames)
+	var outPos uint64
+	for pos := uint64(0); pos < size; {
+		p, err := readFrame(f, size, pos)
+		if err != nil {
+			return false, err
+		}
+		pos += lenWidth + uint64(len(p))
+		p, err = decodeFrame(keys, p)
+		if err != nil {
+			return false, err
+		}
+		p, err = keys.encrypt(keyID, p)
+		if err != nil {
+			return false, err
+		}
+		err = binary.Write(buf, enc, uint64(len(p)))
+		if err != nil {
+			return false, err
+		}
+		_, err = buf.Write(p)
+		if err != nil {
+			return false, err
+		}
+		written = append(written, IndexEntry{Offset: uint32(len(written)), Pos: outPos})
+		outPos += lenWidth + uint64(len(p))
+	}
+	err = buf.Flush()
+	if err != nil {
+		return false, err
+	}
+	err = out.Sync()
+	if err != nil {
+		return false, err
+	}
+	// keep the store's modification time, which retention ages it by
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	err = os.Chtimes(name, fi.ModTime(), fi.ModTime())
+	if err != nil {
+		return false, err
+	}
+	return true, writeIndex(indexName+reencryptExt, written)
+}
+
+// swapSegment renames the segment's rewritten files over its own and reopens
+// it. It returns false, removing the rewritten files, if the segment was
+// removed or the log closed or truncated since the segment was read at the
+// given truncation count.
+func (l *Log) swapSegment(s *segment, truncations uint64) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	storeName := s.store.Name()
+	indexName := s.index.Name()
+	i := -1
+	for j, seg := range l.segments {
+		if seg == s && seg != l.activeSegment {
+			i = j
+		}
+	}
+	if l.closed || i < 0 || l.truncations != truncations {
+		os.Remove(storeName + reencryptExt)
+		os.Remove(indexName + reencryptExt)
+		return false, nil
+	}
+
+	err := s.Close()
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(storeName+reencryptExt, storeName)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(indexName+reencryptExt, indexName)
+	if err != nil {
+		return false, err
+	}
+	ns, err := newSegment(l.Dir, s.baseOffset, l.Config)
+	if err != nil {
+		return false, err
+	}
+	err = ns.seal()
+	if err != nil {
+		return false, err
+	}
+	l.segments[i] = ns
+	return true, nil
+}
@@ -38,6 +38,12 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if err != nil {
 		return nil, err
 	}
+	if keys := c.Encryption.Keyring; keys != nil {
+		// the segment keeps the key that was active when it was opened, so a
+		// rotation applies to the segments created after it
+		s.store.keys = keys
+		s.store.keyID = keys.Active()
+	}
 
 	indexFile, err := os.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
@@ -76,6 +82,9 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	if err != nil {
 		return 0, err
 	}
+	if max := s.config.Segment.MaxRecordBytes; max != 0 && uint64(len(p)) > max {
+		return 0, &RecordTooLargeError{Size: uint64(len(p)), Max: max}
+	}
 
 	_, pos, err := s.store.Append(p)
 	if err != nil {
@@ -111,9 +120,24 @@ func (s *segment) Remove() error {
 	if err != nil {
 		return err
 	}
+	// only segments the log rolled to have a state checkpoint
+	err = os.Remove(s.statePath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
+// Sync commits the store and then the index to stable storage, so a synced
+// index entry never points past the synced end of the store.
+func (s *segment) Sync() error {
+	err := s.store.Sync()
+	if err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
 func (s *segment) Close() error {
 	err := s.index.Close()
 	if err != nil {
@@ -130,15 +154,47 @@ func (s *segment) Close() error {
 func (s *segment) Read(off uint64) (*api.Record, error) {
 	_, pos, err := s.index.Read(int64(off - s.baseOffset))
 	if err != nil {
-		return nil, err
+		return nil, corrupt(off, err)
 	}
 	p, err := s.store.Read(pos)
 	if err != nil {
-		return nil, err
+		return nil, corrupt(off, err)
 	}
 	record := &api.Record{}
 	err = proto.Unmarshal(p, record)
-	return record, err
+	if err != nil {
+		return nil, corrupt(off, err)
+	}
+	return record, nil
+}
+
+// truncateAfter removes the segment's records after off, which it must hold,
+// and leaves it ready to be appended to.
+func (s *segment) truncateAfter(off uint64) error {
+	size := s.store.size
+	if off+1 < s.nextOffset {
+		var err error
+		_, size, err = s.index.Read(int64(off + 1 - s.baseOffset))
+		if err != nil {
+			return err
+		}
+	}
+	err := s.store.truncate(size)
+	if err != nil {
+		return err
+	}
+	err = s.index.truncate((off + 1 - s.baseOffset) * entWidth)
+	if err != nil {
+		return err
+	}
+	s.nextOffset = off + 1
+	return nil
+}
+
+// seal maps the segment's store read-only once it's no longer the active
+// segment.
+func (s *segment) seal() error {
+	return s.store.seal()
 }
 
 // IsMaxed returns whether the segment has reached its max size, either by
@@ -0,0 +1,137 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// Snapshot writes a point-in-time copy of the log to dir, which must be empty
+// or not exist, and describes the segments it holds. The snapshot holds every
+// record appended before the call and none after it, and appends only wait
+// while the snapshot's files are linked, not while they're copied.
+//
+// Sealed segments' stores don't change, so they're hard-linked into dir
+// (falling back to a copy if dir is on another file system) and must not be
+// modified there. The active segment's store is copied up to its current size.
+// Indexes are small and, until the log is closed, padded out to their max
+// size, so each is written out trimmed to its entries. The active store's
+// copied from a file opened while the log was locked, so the copy holds the
+// records as they were then, even if TruncateAfter runs while it's made.
+func (l *Log) Snapshot(dir string) ([]SegmentInfo, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		return nil, fmt.Errorf("snapshot into %s: directory isn't empty", dir)
+	}
+
+	active, snapshot, err := l.snapshotSealed(dir)
+	if active != nil {
+		defer active.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// appends only add to the active segment's store and truncation renames
+	// a new file over it, so copying from the file we opened while holding
+	// the lock gets exactly the records up to its size, even if the segment
+	// has since been appended to, truncated or removed
+	s := &snapshot[len(snapshot)-1]
+	f, err := os.OpenFile(s.StorePath(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, io.NewSectionReader(active, 0, int64(s.StoreBytes)))
+	if err != nil {
+		return nil, err
+	}
+	err = f.Sync()
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// snapshotSealed writes the snapshot's indexes and links its sealed stores
+// while holding the log's lock, and returns the active segment's store opened
+// for the caller to copy.
+func (l *Log) snapshotSealed(dir string) (*os.File, []SegmentInfo, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, nil, ErrLogClosed
+	}
+
+	err := l.activeSegment.store.Sync()
+	if err != nil {
+		return nil, nil, err
+	}
+	active, err := os.Open(l.activeSegment.store.Name())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var snapshot []SegmentInfo
+	for _, s := range l.segments {
+		info := SegmentInfo{
+			Dir:        dir,
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreBytes: s.store.size,
+			IndexBytes: s.index.size,
+			Entries:    s.nextOffset - s.baseOffset,
+		}
+		err = ioutil.WriteFile(info.IndexPath(), s.index.mmap[:s.index.size], 0644)
+		if err != nil {
+			return active, nil, err
+		}
+		if s != l.activeSegment {
+			err = linkOrCopy(s.store.Name(), info.StorePath())
+			if err != nil {
+				return active, nil, err
+			}
+		}
+		snapshot = append(snapshot, info)
+	}
+	return active, snapshot, nil
+}
+
+// linkOrCopy hard-links src to dst, copying it if they're on different file
+// systems.
+func linkOrCopy(src, dst string) error {
+	err := os.Link(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
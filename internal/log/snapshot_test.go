@@ -0,0 +1,73 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	require.NoError(t, os.Mkdir(path.Join(dir, "log"), 0755))
+	l, err := NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// keep appending while the snapshot is taken
+	var wg sync.WaitGroup
+	var appendErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10 && appendErr == nil; i++ {
+			_, appendErr = l.Append(&api.Record{Value: []byte("after")})
+		}
+	}()
+	snapshot, err := l.Snapshot(path.Join(dir, "snapshot"))
+	require.NoError(t, err)
+	wg.Wait()
+	require.NoError(t, appendErr)
+
+	next := snapshot[len(snapshot)-1].NextOffset
+	require.True(t, next >= 3)
+	segments, err := InspectDir(path.Join(dir, "snapshot"))
+	require.NoError(t, err)
+	require.Equal(t, len(snapshot), len(segments))
+	for i := range segments {
+		require.Equal(t, snapshot[i], segments[i])
+	}
+	problems, err := Verify(path.Join(dir, "snapshot"), nil)
+	require.NoError(t, err)
+	require.Empty(t, problems)
+
+	s, err := NewLog(path.Join(dir, "snapshot"), l.Config)
+	require.NoError(t, err)
+	off, err := s.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, next-1, off)
+	record, err := s.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.NoError(t, s.Close())
+
+	// the log is unaffected by the snapshot
+	off, err = l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(12), off)
+
+	_, err = l.Snapshot(path.Join(dir, "snapshot"))
+	require.Error(t, err)
+}
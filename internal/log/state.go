@@ -0,0 +1,140 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// stateExt is the extension of the file a segment's state checkpoint is kept
+// in, beside its store and index.
+const stateExt = ".state"
+
+// stateCheckpoint is the idempotent producers' and transactions' state as of
+// a segment's base offset. It's saved when the log rolls to the segment, so
+// that rebuilding the state replays the records from the newest checkpoint on
+// rather than every record in the log.
+type stateCheckpoint struct {
+	Producers   map[string][]producerCheckpoint `json:"producers"`
+	OpenTxns    map[string]openTxnCheckpoint    `json:"open_txns"`
+	AbortedTxns map[string][][2]uint64          `json:"aborted_txns"`
+}
+
+// producerCheckpoint is one of a producer's latest appends.
+type producerCheckpoint struct {
+	Sequence uint64 `json:"sequence"`
+	Offset   uint64 `json:"offset"`
+}
+
+// openTxnCheckpoint is an open transaction's begin marker.
+type openTxnCheckpoint struct {
+	Offset uint64    `json:"offset"`
+	Begun  time.Time `json:"begun"`
+}
+
+// statePath returns the path of the segment's state checkpoint.
+func (s *segment) statePath() string {
+	return strings.TrimSuffix(s.store.Name(), ".store") + stateExt
+}
+
+// saveState checkpoints the state beside the active segment, which must not
+// have been appended to yet. The checkpoint is written to a temporary file
+// that's renamed over it, so a crash leaves either the whole checkpoint or
+// none.
+func (l *Log) saveState() error {
+	c := stateCheckpoint{
+		Producers:   make(map[string][]producerCheckpoint, len(l.producers)),
+		OpenTxns:    make(map[string]openTxnCheckpoint, len(l.openTxns)),
+		AbortedTxns: make(map[string][][2]uint64, len(l.abortedTxns)),
+	}
+	for id, p := range l.producers {
+		for _, a := range p.appends {
+			c.Producers[id] = append(c.Producers[id], producerCheckpoint{a.sequence, a.offset})
+		}
+	}
+	for id, txn := range l.openTxns {
+		c.OpenTxns[id] = openTxnCheckpoint{txn.offset, txn.begun}
+	}
+	for id, ranges := range l.abortedTxns {
+		for _, r := range ranges {
+			c.AbortedTxns[id] = append(c.AbortedTxns[id], [2]uint64{r.first, r.last})
+		}
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	name := l.activeSegment.statePath()
+	f, err := ioutil.TempFile(l.Dir, ".state")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// loadCheckpoint replaces the state with the segment's checkpoint, and
+// returns false if it has none. A checkpoint that can't be decoded is taken
+// to be missing, since the records it stands for can be replayed instead.
+func (l *Log) loadCheckpoint(s *segment) (bool, error) {
+	b, err := ioutil.ReadFile(s.statePath())
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var c stateCheckpoint
+	if json.Unmarshal(b, &c) != nil {
+		return false, nil
+	}
+	for id, appends := range c.Producers {
+		p := &producerState{}
+		for _, a := range appends {
+			p.appends = append(p.appends, producerAppend{sequence: a.Sequence, offset: a.Offset})
+		}
+		l.producers[id] = p
+	}
+	for id, txn := range c.OpenTxns {
+		l.openTxns[id] = openTxn{offset: txn.Offset, begun: txn.Begun}
+	}
+	for id, ranges := range c.AbortedTxns {
+		for _, r := range ranges {
+			l.abortedTxns[id] = append(l.abortedTxns[id], offsetRange{r[0], r[1]})
+		}
+	}
+	return true, nil
+}
+
+// removeCheckpoints removes the state checkpoints in dir, so the log rebuilds
+// its state from every record when it's next opened.
+func removeCheckpoints(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || path.Ext(file.Name()) != stateExt {
+			continue
+		}
+		err = os.Remove(path.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	open, err := log.Begin("open")
+	require.NoError(t, err)
+	produce := func(seq uint64) uint64 {
+		off, err := log.Append(&api.Record{Value: []byte("produced"), ProducerId: "p", Sequence: seq})
+		require.NoError(t, err)
+		return off
+	}
+	for seq := uint64(0); seq < 4; seq++ {
+		produce(seq)
+	}
+	_, err = log.Begin("aborted")
+	require.NoError(t, err)
+	aborted, err := log.Append(&api.Record{Value: []byte("aborted"), TransactionId: "aborted"})
+	require.NoError(t, err)
+	_, err = log.Abort("aborted")
+	require.NoError(t, err)
+	last := produce(4)
+	for i := 0; i < 4; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("plain")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 3)
+	first := log.segments[0]
+	for _, s := range log.segments[1:] {
+		_, err = os.Stat(s.statePath())
+		require.NoError(t, err)
+	}
+	_, err = os.Stat(first.statePath())
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, log.Close())
+
+	// reopening replays only from the newest checkpoint, so it doesn't read
+	// the first segment's records
+	b, err := ioutil.ReadFile(first.store.Name())
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(first.store.Name(), bytes.Repeat([]byte{0xff}, len(b)), 0644))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	check := func() {
+		require.Equal(t, open, log.LastStableOffset())
+		require.True(t, log.aborted(&api.Record{TransactionId: "aborted", Offset: aborted}))
+		off, err := log.Append(&api.Record{Value: []byte("produced"), ProducerId: "p", Sequence: 4})
+		require.NoError(t, err)
+		require.Equal(t, last, off)
+	}
+	check()
+
+	// truncating rebuilds the state from the checkpoint of the segment that's
+	// kept, and removes those of the segments after it
+	removed := log.segments[len(log.segments)-1]
+	require.NoError(t, log.TruncateAfter(last))
+	_, err = os.Stat(removed.statePath())
+	require.True(t, os.IsNotExist(err))
+	check()
+}
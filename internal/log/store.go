@@ -3,8 +3,11 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"io"
 	"os"
 	"sync"
+
+	"github.com/tysontate/gommap"
 )
 
 var enc = binary.BigEndian
@@ -17,6 +20,13 @@ type store struct {
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// keys decrypts encrypted frames, and keyID, if set, names the key
+	// appended frames are encrypted with.
+	keys  *Keyring
+	keyID string
+	// mmap maps a sealed store read-only, letting reads skip the lock, the
+	// buffer flush and the syscalls
+	mmap gommap.MMap
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -36,6 +46,13 @@ func newStore(f *os.File) (*store, error) {
 func (s *store) Append(p []byte) (uint64, uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.keyID != "" {
+		var err error
+		p, err = s.keys.encrypt(s.keyID, p)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
 	err := binary.Write(s.buf, enc, uint64(len(p)))
 	if err != nil {
 		return 0, 0, err
@@ -54,8 +71,12 @@ func (s *store) Append(p []byte) (uint64, uint64, error) {
 	return uint64(w), pos, nil
 }
 
-// Read returns the record stored at the given position
+// Read returns the record stored at the given position. A sealed store's
+// plaintext records are slices of its mapping, valid until it's closed.
 func (s *store) Read(pos uint64) ([]byte, error) {
+	if s.mmap != nil {
+		return s.readMapped(pos)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	// flush the writer buffer in case we’re about to try to read a record that the buffer
@@ -76,7 +97,118 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return b, nil
+	return decodeFrame(s.keys, b)
+}
+
+func (s *store) readMapped(pos uint64) ([]byte, error) {
+	size := uint64(len(s.mmap))
+	if pos+lenWidth > size {
+		return nil, io.EOF
+	}
+	n := enc.Uint64(s.mmap[pos : pos+lenWidth])
+	if n > size-pos-lenWidth {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return decodeFrame(s.keys, s.mmap[pos+lenWidth:pos+lenWidth+n])
+}
+
+// seal flushes the store and maps it read-only for reading. The store mustn't
+// be appended to afterwards.
+func (s *store) seal() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mmap != nil {
+		return nil
+	}
+	err := s.buf.Flush()
+	if err != nil {
+		return err
+	}
+	// an empty file can't be mapped
+	if s.size == 0 {
+		return nil
+	}
+	s.mmap, err = gommap.Map(s.File.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+	return err
+}
+
+// truncateExt is the extension of the file a store's cut down into before
+// it's renamed over the store.
+const truncateExt = ".truncate"
+
+// truncate cuts the store down to size bytes, unmapping it if it's sealed so
+// it can be appended to again. The first size bytes are copied to a new file
+// that's renamed over the store, rather than the store being cut in place, so
+// that snapshots hard-linked to it and files opened on it beforehand keep
+// what they held.
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.buf.Flush()
+	if err != nil {
+		return err
+	}
+	name := s.File.Name()
+	tmp, err := os.OpenFile(name+truncateExt, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(s.File, 0, int64(size)))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if s.mmap != nil {
+		err = s.mmap.UnsafeUnmap()
+		if err != nil {
+			return err
+		}
+		s.mmap = nil
+	}
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	err = s.File.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.File = f
+	s.buf = bufio.NewWriter(f)
+	s.size = size
+	return nil
+}
+
+// flush writes the buffered appends to the file.
+func (s *store) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Flush()
+}
+
+// Sync flushes the write buffer and commits the file's contents to stable
+// storage.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.buf.Flush()
+	if err != nil {
+		return err
+	}
+	return s.File.Sync()
 }
 
 // Close persists any buffered data before closing the file.
@@ -87,5 +219,12 @@ func (s *store) Close() error {
 	if err != nil {
 		return err
 	}
+	if s.mmap != nil {
+		err = s.mmap.UnsafeUnmap()
+		if err != nil {
+			return err
+		}
+		s.mmap = nil
+	}
 	return s.File.Close()
 }
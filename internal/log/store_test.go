@@ -86,3 +86,68 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+func TestStoreSeal(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_seal_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f)
+	require.NoError(t, err)
+	var positions []uint64
+	for i := 0; i < 3; i++ {
+		_, pos, err := s.Append(write)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+
+	require.NoError(t, s.seal())
+	require.NotNil(t, s.mmap)
+	for _, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+	_, err = s.Read(s.size)
+	require.Error(t, err)
+	require.NoError(t, s.Close())
+}
+
+// BenchmarkStoreRead compares reading records through the write buffer and
+// ReadAt, as the active segment does, with reading a sealed store's mapping.
+func BenchmarkStoreRead(b *testing.B) {
+	for _, sealed := range []bool{false, true} {
+		name := "buffered"
+		if sealed {
+			name = "mmap"
+		}
+		b.Run(name, func(b *testing.B) {
+			f, err := ioutil.TempFile("", "store_read_bench")
+			require.NoError(b, err)
+			defer os.Remove(f.Name())
+			s, err := newStore(f)
+			require.NoError(b, err)
+			defer s.Close()
+
+			record := make([]byte, 256)
+			var positions []uint64
+			for i := 0; i < 1024; i++ {
+				_, pos, err := s.Append(record)
+				require.NoError(b, err)
+				positions = append(positions, pos)
+			}
+			if sealed {
+				require.NoError(b, s.seal())
+			}
+
+			b.SetBytes(int64(len(record)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := s.Read(positions[i%len(positions)])
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,531 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+)
+
+// ErrBlobNotFound is returned by a BlobStore's Get when there's no blob with
+// the name.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore is where tiered storage uploads sealed segments' files to, so
+// their local copies can be removed.
+type BlobStore interface {
+	// Put stores the contents of r under name, replacing any blob with
+	// that name.
+	Put(name string, r io.Reader) error
+	// Get opens the blob with name, returning ErrBlobNotFound if there
+	// isn't one.
+	Get(name string) (io.ReadCloser, error)
+	// Delete removes the blob with name, if there is one.
+	Delete(name string) error
+}
+
+// DirBlobStore is a BlobStore keeping blobs as files in a directory, such as
+// one on a bigger, slower disk or a network file system.
+type DirBlobStore struct {
+	Dir string
+}
+
+// NewDirBlobStore returns a BlobStore keeping blobs in dir, creating dir if
+// it doesn't exist.
+func NewDirBlobStore(dir string) (*DirBlobStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &DirBlobStore{Dir: dir}, nil
+}
+
+// Put writes the blob to a temporary file and renames it into place, so a
+// blob is never seen half written.
+func (d *DirBlobStore) Put(name string, r io.Reader) error {
+	f, err := ioutil.TempFile(d.Dir, "."+name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path.Join(d.Dir, name))
+}
+
+func (d *DirBlobStore) Get(name string) (io.ReadCloser, error) {
+	f, err := os.Open(path.Join(d.Dir, name))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", name, ErrBlobNotFound)
+	}
+	return f, err
+}
+
+func (d *DirBlobStore) Delete(name string) error {
+	err := os.Remove(path.Join(d.Dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+const (
+	// tierManifest is the blob listing the uploaded segments.
+	tierManifest = "segments.json"
+	// tierCacheDir is the subdirectory of a log's directory that segments
+	// fetched from the blob store are cached in.
+	tierCacheDir = "tier-cache"
+)
+
+// remoteSegment describes a segment uploaded to the blob store.
+type remoteSegment struct {
+	BaseOffset uint64    `json:"base_offset"`
+	NextOffset uint64    `json:"next_offset"`
+	StoreBytes uint64    `json:"store_bytes"`
+	ModTime    time.Time `json:"mod_time"`
+}
+
+func storeBlob(baseOffset uint64) string { return fmt.Sprintf("%d.store", baseOffset) }
+func indexBlob(baseOffset uint64) string { return fmt.Sprintf("%d.index", baseOffset) }
+
+// loadTier reads the list of uploaded segments from the blob store and empties
+// the cache of fetched segments.
+func (l *Log) loadTier() error {
+	blobs := l.Config.Tiering.Blobs
+	if blobs == nil {
+		return nil
+	}
+	dir := path.Join(l.Dir, tierCacheDir)
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	err = os.Mkdir(dir, 0755)
+	if err != nil {
+		return err
+	}
+	max := l.Config.Tiering.CacheSegments
+	if max == 0 {
+		max = 4
+	}
+	l.cache = &segmentCache{
+		dir:      dir,
+		max:      max,
+		blobs:    blobs,
+		config:   l.Config,
+		segments: make(map[uint64]*segment),
+	}
+
+	rc, err := blobs.Get(tierManifest)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(&l.remote)
+}
+
+// saveTier writes the list of uploaded segments to the blob store.
+func (l *Log) saveTier() error {
+	b, err := json.Marshal(l.remote)
+	if err != nil {
+		return err
+	}
+	return l.Config.Tiering.Blobs.Put(tierManifest, bytes.NewReader(b))
+}
+
+// uploaded reports whether the segment with the base offset is in the blob
+// store.
+func (l *Log) uploaded(baseOffset uint64) bool {
+	i := sort.Search(len(l.remote), func(i int) bool {
+		return l.remote[i].BaseOffset >= baseOffset
+	})
+	return i < len(l.remote) && l.remote[i].BaseOffset == baseOffset
+}
+
+// readRemote reads the record at off from the uploaded segments, if one of
+// them holds it, fetching the segment into the cache. The caller must hold
+// the read lock, which is released while the segment's fetched.
+func (l *Log) readRemote(off uint64) (*api.Record, bool, error) {
+	r, ok, err := l.fetchRemote(off)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+	record, err := l.cache.read(r, off)
+	return record, true, err
+}
+
+// fetchRemote returns the uploaded segment holding off, if there is one,
+// having made sure it's cached. The caller must hold the read lock; it's
+// released while the segment's downloaded, so that a slow blob store doesn't
+// hold up appends and every read queued behind them, and taken again after.
+func (l *Log) fetchRemote(off uint64) (remoteSegment, bool, error) {
+	r, ok := l.remoteFor(off)
+	if !ok || l.cache.cached(r.BaseOffset) {
+		return r, ok, nil
+	}
+	l.mu.RUnlock()
+	err := l.cache.load(r)
+	l.mu.RLock()
+	// the segment may have been removed or the log closed in the meantime,
+	// which would also explain a failed download
+	if l.closed {
+		return r, true, ErrLogClosed
+	}
+	r, ok = l.remoteFor(off)
+	if !ok {
+		return r, false, nil
+	}
+	return r, true, err
+}
+
+// remoteFor returns the uploaded segment holding off, if there is one.
+func (l *Log) remoteFor(off uint64) (remoteSegment, bool) {
+	i := sort.Search(len(l.remote), func(i int) bool {
+		return l.remote[i].NextOffset > off
+	})
+	if i == len(l.remote) || off < l.remote[i].BaseOffset {
+		return remoteSegment{}, false
+	}
+	return l.remote[i], true
+}
+
+// removeRemote deletes the segment with the base offset from the blob store,
+// if it was uploaded.
+func (l *Log) removeRemote(baseOffset uint64) error {
+	i := sort.Search(len(l.remote), func(i int) bool {
+		return l.remote[i].BaseOffset >= baseOffset
+	})
+	if i == len(l.remote) || l.remote[i].BaseOffset != baseOffset {
+		return nil
+	}
+	r := l.remote[i]
+	l.cache.evict(r.BaseOffset)
+	l.remote = append(l.remote[:i:i], l.remote[i+1:]...)
+	err := l.saveTier()
+	if err != nil {
+		return err
+	}
+	err = l.Config.Tiering.Blobs.Delete(storeBlob(r.BaseOffset))
+	if err != nil {
+		return err
+	}
+	return l.Config.Tiering.Blobs.Delete(indexBlob(r.BaseOffset))
+}
+
+// Offload uploads the sealed segments that aren't in the blob store yet, then
+// removes the local copies of uploaded segments that haven't been written to
+// for longer than the tiering's local age. It returns how many segments it
+// uploaded. Segments are uploaded without holding the log's lock, so it can
+// run in the background while the log's in use.
+func (l *Log) Offload() (int, error) {
+	if l.Config.Tiering.Blobs == nil {
+		return 0, errors.New("log has no blob store")
+	}
+	l.mu.RLock()
+	if l.closed {
+		l.mu.RUnlock()
+		return 0, ErrLogClosed
+	}
+	var pending []uint64
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if !l.uploaded(s.baseOffset) {
+			pending = append(pending, s.baseOffset)
+		}
+	}
+	l.mu.RUnlock()
+
+	var n int
+	for _, off := range pending {
+		ok, err := l.upload(off)
+		if err != nil {
+			return n, fmt.Errorf("segment %d: %v", off, err)
+		}
+		if ok {
+			n++
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return n, l.removeLocal()
+}
+
+// upload copies the sealed segment's files to the blob store and adds it to
+// the uploaded segments. It returns false if the segment was removed or
+// truncated or the log closed in the meantime.
+func (l *Log) upload(baseOffset uint64) (bool, error) {
+	blobs := l.Config.Tiering.Blobs
+	// open the store and copy the index's entries under the lock, so
+	// Reencrypt can't swap the files underneath us
+	l.mu.RLock()
+	s := l.localSegment(baseOffset)
+	if l.closed || s == nil {
+		l.mu.RUnlock()
+		return false, nil
+	}
+	f, err := os.Open(s.store.Name())
+	if err != nil {
+		l.mu.RUnlock()
+		return false, err
+	}
+	defer f.Close()
+	r := remoteSegment{
+		BaseOffset: s.baseOffset,
+		NextOffset: s.nextOffset,
+		StoreBytes: s.store.size,
+	}
+	index := append([]byte(nil), s.index.mmap[:s.index.size]...)
+	truncations := l.truncations
+	l.mu.RUnlock()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	r.ModTime = fi.ModTime()
+	err = blobs.Put(storeBlob(r.BaseOffset), io.LimitReader(f, int64(r.StoreBytes)))
+	if err != nil {
+		return false, err
+	}
+	err = blobs.Put(indexBlob(r.BaseOffset), bytes.NewReader(index))
+	if err != nil {
+		return false, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.localSegment(r.BaseOffset) == nil || l.uploaded(r.BaseOffset) ||
+		l.truncations != truncations {
+		if !l.uploaded(r.BaseOffset) {
+			blobs.Delete(storeBlob(r.BaseOffset))
+			blobs.Delete(indexBlob(r.BaseOffset))
+		}
+		return false, nil
+	}
+	l.remote = append(l.remote, r)
+	sort.Slice(l.remote, func(i, j int) bool {
+		return l.remote[i].BaseOffset < l.remote[j].BaseOffset
+	})
+	return true, l.saveTier()
+}
+
+// localSegment returns the local segment with the base offset, or nil if
+// there isn't one.
+func (l *Log) localSegment(baseOffset uint64) *segment {
+	for _, s := range l.segments {
+		if s.baseOffset == baseOffset {
+			return s
+		}
+	}
+	return nil
+}
+
+// removeLocal removes the oldest local segments that have been uploaded and
+// haven't been written to for longer than the tiering's local age.
+func (l *Log) removeLocal() error {
+	age := l.Config.Tiering.LocalAge
+	if age == 0 {
+		return nil
+	}
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+		if !l.uploaded(s.baseOffset) {
+			break
+		}
+		fi, err := os.Stat(s.store.Name())
+		if err != nil {
+			return err
+		}
+		if time.Since(fi.ModTime()) <= age {
+			break
+		}
+		err = s.Remove()
+		if err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// segmentCache holds the segments most recently fetched from the blob store.
+type segmentCache struct {
+	mu       sync.Mutex
+	dir      string
+	max      int
+	blobs    BlobStore
+	config   Config
+	segments map[uint64]*segment
+	// order holds the cached segments' base offsets, least recently used
+	// first
+	order []uint64
+}
+
+// read returns the record at off from the uploaded segment r, fetching r if
+// it isn't cached.
+func (c *segmentCache) read(r remoteSegment, off uint64) (*api.Record, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, err := c.get(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.Read(off)
+}
+
+// cached reports whether the uploaded segment with the base offset is cached.
+func (c *segmentCache) cached(baseOffset uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.segments[baseOffset]
+	return ok
+}
+
+// load fetches the uploaded segment r into the cache if it isn't cached.
+func (c *segmentCache) load(r remoteSegment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.get(r)
+	return err
+}
+
+// frames returns the run of up to max frames starting at off in the uploaded
+// segment r, fetching r if it isn't cached.
+func (c *segmentCache) frames(r remoteSegment, off, max uint64) (frameRange, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, err := c.get(r)
+	if err != nil {
+		return frameRange{}, err
+	}
+	return s.frames(off, max)
+}
+
+// get returns the cached segment r, fetching it if it isn't cached and
+// evicting the least recently used segment if the cache's full.
+func (c *segmentCache) get(r remoteSegment) (*segment, error) {
+	s, ok := c.segments[r.BaseOffset]
+	if !ok {
+		var err error
+		s, err = c.fetch(r)
+		if err != nil {
+			return nil, fmt.Errorf("fetching segment %d: %v", r.BaseOffset, err)
+		}
+		if len(c.order) == c.max {
+			c.remove(c.order[0])
+		}
+		c.segments[r.BaseOffset] = s
+	}
+	c.touch(r.BaseOffset)
+	return s, nil
+}
+
+// fetch downloads the uploaded segment's files into the cache directory and
+// opens them.
+func (c *segmentCache) fetch(r remoteSegment) (*segment, error) {
+	for _, name := range []string{storeBlob(r.BaseOffset), indexBlob(r.BaseOffset)} {
+		rc, err := c.blobs.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Create(path.Join(c.dir, name))
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		_, err = io.Copy(f, rc)
+		rc.Close()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		err = f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	s, err := newSegment(c.dir, r.BaseOffset, c.config)
+	if err != nil {
+		return nil, err
+	}
+	return s, s.seal()
+}
+
+// touch moves the segment to the end of the order, as the most recently
+// used.
+func (c *segmentCache) touch(baseOffset uint64) {
+	for i, off := range c.order {
+		if off == baseOffset {
+			c.order = append(c.order[:i:i], c.order[i+1:]...)
+			break
+		}
+	}
+	c.order = append(c.order, baseOffset)
+}
+
+// remove closes and removes the cached segment.
+func (c *segmentCache) remove(baseOffset uint64) {
+	s, ok := c.segments[baseOffset]
+	if !ok {
+		return
+	}
+	for i, off := range c.order {
+		if off == baseOffset {
+			c.order = append(c.order[:i:i], c.order[i+1:]...)
+			break
+		}
+	}
+	delete(c.segments, baseOffset)
+	s.Remove()
+}
+
+// evict removes the segment from the cache, if it's cached.
+func (c *segmentCache) evict(baseOffset uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remove(baseOffset)
+}
+
+// Close closes and removes the cached segments.
+func (c *segmentCache) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range c.segments {
+		err := s.Close()
+		if err != nil {
+			return err
+		}
+	}
+	c.segments = nil
+	c.order = nil
+	return os.RemoveAll(c.dir)
+}
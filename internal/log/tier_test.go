@@ -0,0 +1,212 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTieredStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+	blobs, err := NewDirBlobStore(path.Join(dir, "blobs"))
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Tiering.Blobs = blobs
+	c.Tiering.LocalAge = time.Nanosecond
+	c.Tiering.CacheSegments = 1
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	n, err := log.Offload()
+	require.NoError(t, err)
+	require.True(t, n > 0)
+	n, err = log.Offload()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	// only the active segment's left on disk
+	segments, err := InspectDir(logDir)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(segments))
+	require.NotEqual(t, uint64(0), segments[0].BaseOffset)
+
+	check := func(log *Log) {
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), lowest)
+		for off := uint64(0); off < 10; off++ {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+		}
+		// fetched segments are cached up to the limit
+		cached, err := ioutil.ReadDir(path.Join(logDir, tierCacheDir))
+		require.NoError(t, err)
+		require.True(t, len(cached) <= 2, "%d cached files", len(cached))
+	}
+	check(log)
+	require.NoError(t, log.Close())
+	log, err = NewLog(logDir, c)
+	require.NoError(t, err)
+	check(log)
+	records, _, err := log.Scan(0, 10, ReadCommitted)
+	require.NoError(t, err)
+	require.Equal(t, 10, len(records))
+
+	// truncating removes uploaded segments from the blob store
+	require.NoError(t, log.Truncate(4))
+	_, err = log.Read(0)
+	require.Error(t, err)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.True(t, lowest > 0 && lowest <= 5, "lowest offset %d", lowest)
+	_, err = blobs.Get(storeBlob(0))
+	require.True(t, errors.Is(err, ErrBlobNotFound), "%v", err)
+	record, err := log.Read(9)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 9"), record.Value)
+	require.NoError(t, log.Close())
+}
+
+func TestTieredState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-state-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+	blobs, err := NewDirBlobStore(path.Join(dir, "blobs"))
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Tiering.Blobs = blobs
+	c.Tiering.LocalAge = time.Nanosecond
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+
+	produced, err := log.Append(&api.Record{Value: []byte("produced"), ProducerId: "producer"})
+	require.NoError(t, err)
+	_, err = log.Begin("aborted")
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("aborted"), TransactionId: "aborted"})
+	require.NoError(t, err)
+	_, err = log.Abort("aborted")
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("committed")})
+	require.NoError(t, err)
+	open, err := log.Begin("open")
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("after")})
+		require.NoError(t, err)
+	}
+	_, err = log.Offload()
+	require.NoError(t, err)
+	segments, err := InspectDir(logDir)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(segments))
+	require.True(t, segments[0].BaseOffset > open)
+	require.NoError(t, log.Close())
+
+	// the state of the offloaded segments' records survives reopening
+	log, err = NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	require.Equal(t, open, log.LastStableOffset())
+	records, _, err := log.Scan(0, 100, ReadCommitted)
+	require.NoError(t, err)
+	var values []string
+	for _, record := range records {
+		values = append(values, string(record.Value))
+	}
+	require.Equal(t, []string{"produced", "committed"}, values)
+	off, err := log.Append(&api.Record{Value: []byte("produced"), ProducerId: "producer"})
+	require.NoError(t, err)
+	require.Equal(t, produced, off)
+}
+
+// gatedBlobStore holds up Gets while its gate is set.
+type gatedBlobStore struct {
+	BlobStore
+	mu      sync.Mutex
+	gate    chan struct{}
+	getting chan struct{}
+}
+
+func (b *gatedBlobStore) Get(name string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	gate := b.gate
+	b.mu.Unlock()
+	if gate != nil {
+		b.getting <- struct{}{}
+		<-gate
+	}
+	return b.BlobStore.Get(name)
+}
+
+func TestTieredFetchUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-fetch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.Mkdir(logDir, 0755))
+	dirBlobs, err := NewDirBlobStore(path.Join(dir, "blobs"))
+	require.NoError(t, err)
+	blobs := &gatedBlobStore{BlobStore: dirBlobs, getting: make(chan struct{}, 2)}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Tiering.Blobs = blobs
+	c.Tiering.LocalAge = time.Nanosecond
+	c.Tiering.CacheSegments = 1
+	log, err := NewLog(logDir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	_, err = log.Offload()
+	require.NoError(t, err)
+
+	// appends and local reads carry on while a read waits on the blob store
+	blobs.mu.Lock()
+	blobs.gate = make(chan struct{})
+	blobs.mu.Unlock()
+	read := make(chan error)
+	go func() {
+		_, err := log.Read(0)
+		read <- err
+	}()
+	<-blobs.getting
+	off, err := log.Append(&api.Record{Value: []byte("record 4")})
+	require.NoError(t, err)
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 4"), record.Value)
+
+	blobs.mu.Lock()
+	close(blobs.gate)
+	blobs.gate = nil
+	blobs.mu.Unlock()
+	require.NoError(t, <-read)
+}
@@ -0,0 +1,256 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+)
+
+// Isolation is which records a Scan sees.
+type Isolation int
+
+const (
+	// ReadUncommitted sees every data record, including those of open and
+	// aborted transactions.
+	ReadUncommitted Isolation = iota
+	// ReadCommitted sees records outside transactions and those of committed
+	// transactions, and nothing from the last stable offset on.
+	ReadCommitted
+)
+
+var (
+	// ErrTransactionOpen is returned when beginning a transaction that's
+	// already open.
+	ErrTransactionOpen = errors.New("transaction already open")
+	// ErrTransactionNotOpen is returned when appending to, committing or
+	// aborting a transaction that hasn't begun or has already ended.
+	ErrTransactionNotOpen = errors.New("transaction not open")
+	// ErrNotCommitted is returned when reading a transaction marker, a record
+	// of an aborted transaction or one from the last stable offset on at the
+	// read-committed isolation level.
+	ErrNotCommitted = errors.New("record not committed")
+)
+
+// openTxn is an open transaction's begin marker.
+type openTxn struct {
+	offset uint64
+	begun  time.Time
+}
+
+// offsetRange is the offsets from first to last, inclusive.
+type offsetRange struct {
+	first, last uint64
+}
+
+// Begin appends a marker that begins the transaction with the given ID, and
+// returns its offset. Records appended with the ID are then part of the
+// transaction until it's committed or aborted.
+func (l *Log) Begin(id string) (uint64, error) {
+	return l.Append(&api.Record{TransactionId: id, Marker: api.Marker_MARKER_BEGIN})
+}
+
+// Commit appends a marker that commits the transaction, making its records
+// visible to read-committed consumers. A transaction that's been open for
+// longer than the configured timeout has been aborted, so committing it fails
+// with ErrTransactionNotOpen.
+func (l *Log) Commit(id string) (uint64, error) {
+	return l.Append(&api.Record{TransactionId: id, Marker: api.Marker_MARKER_COMMIT})
+}
+
+// Abort appends a marker that aborts the transaction, hiding its records from
+// read-committed consumers.
+func (l *Log) Abort(id string) (uint64, error) {
+	return l.Append(&api.Record{TransactionId: id, Marker: api.Marker_MARKER_ABORT})
+}
+
+// LastStableOffset returns the offset of the first transaction that's still
+// open, or the next offset to be written if none are. Read-committed
+// consumers see only the records before it.
+func (l *Log) LastStableOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.lastStableOffset()
+}
+
+func (l *Log) lastStableOffset() uint64 {
+	lso := l.activeSegment.nextOffset
+	for _, txn := range l.openTxns {
+		if txn.offset < lso {
+			lso = txn.offset
+		}
+	}
+	return lso
+}
+
+// Scan returns up to max records from offset from on, leaving out transaction
+// markers, along with the offset to scan from next. Read-committed scans also
+// leave out aborted transactions' records and stop at the last stable offset,
+// so they may return no records even though there are more in the log.
+func (l *Log) Scan(from uint64, max int, isolation Isolation) ([]*api.Record, uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, from, ErrLogClosed
+	}
+	// reading an uploaded segment releases the lock while it's fetched, so
+	// the end's checked again after every read
+	end := func() uint64 {
+		if isolation == ReadCommitted {
+			return l.lastStableOffset()
+		}
+		return l.activeSegment.nextOffset
+	}
+	var records []*api.Record
+	off := from
+	for ; off < end() && len(records) < max; off++ {
+		record, err := l.read(off)
+		if err != nil {
+			return nil, from, err
+		}
+		if record.Marker != api.Marker_MARKER_NONE ||
+			isolation == ReadCommitted && l.aborted(record) {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, off, nil
+}
+
+// ReadIsolated reads the record at off as a scan at the isolation level would
+// see it. Read-committed reads of records that such a scan leaves out fail
+// with ErrNotCommitted, while read-uncommitted ones are the same as Read.
+func (l *Log) ReadIsolated(off uint64, isolation Isolation) (*api.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return nil, ErrLogClosed
+	}
+	record, err := l.read(off)
+	if err != nil || isolation != ReadCommitted {
+		return record, err
+	}
+	// the last stable offset's checked after the read, since reading an
+	// uploaded segment releases the lock
+	if off >= l.lastStableOffset() ||
+		record.Marker != api.Marker_MARKER_NONE ||
+		l.aborted(record) {
+		return nil, fmt.Errorf("offset %d: %w", off, ErrNotCommitted)
+	}
+	return record, nil
+}
+
+// checkTxn returns an error if appending the record would misuse its
+// transaction.
+func (l *Log) checkTxn(record *api.Record) error {
+	id := record.TransactionId
+	if id == "" {
+		if record.Marker != api.Marker_MARKER_NONE {
+			return errors.New("transaction marker without a transaction ID")
+		}
+		return nil
+	}
+	_, open := l.openTxns[id]
+	if record.Marker == api.Marker_MARKER_BEGIN && open {
+		return fmt.Errorf("transaction %s: %w", id, ErrTransactionOpen)
+	}
+	if record.Marker != api.Marker_MARKER_BEGIN && !open {
+		return fmt.Errorf("transaction %s: %w", id, ErrTransactionNotOpen)
+	}
+	return nil
+}
+
+// trackTxn updates the transactions' state for the appended record.
+func (l *Log) trackTxn(record *api.Record) {
+	id := record.TransactionId
+	switch record.Marker {
+	case api.Marker_MARKER_BEGIN:
+		l.openTxns[id] = openTxn{offset: record.Offset, begun: record.AppendTime.AsTime()}
+	case api.Marker_MARKER_COMMIT:
+		delete(l.openTxns, id)
+	case api.Marker_MARKER_ABORT:
+		// if retention removed the begin marker, it removed everything
+		// before it too
+		first := l.openTxns[id].offset
+		l.abortedTxns[id] = append(l.abortedTxns[id], offsetRange{first, record.Offset})
+		delete(l.openTxns, id)
+	}
+}
+
+// aborted reports whether the record belongs to an aborted transaction.
+func (l *Log) aborted(record *api.Record) bool {
+	for _, r := range l.abortedTxns[record.TransactionId] {
+		if r.first <= record.Offset && record.Offset <= r.last {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneTxns forgets the aborted transactions whose records have all been
+// removed from the log.
+func (l *Log) pruneTxns() {
+	if len(l.segments) == 0 {
+		return
+	}
+	lowest := l.lowestOffset()
+	for id, ranges := range l.abortedTxns {
+		var kept []offsetRange
+		for _, r := range ranges {
+			if r.last >= lowest {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			delete(l.abortedTxns, id)
+			continue
+		}
+		l.abortedTxns[id] = kept
+	}
+}
+
+// expireTxns aborts the transactions that outlive the timeout, checking a few
+// times a timeout, until the log's closed.
+func (l *Log) expireTxns() {
+	ticker := time.NewTicker(l.Config.Transactions.Timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			// an error here is one the next append runs into too, so it's
+			// left to that to report
+			_, _ = l.abortExpired(now)
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+// abortExpired appends abort markers for the transactions that began longer
+// than the timeout before now, and returns how many it aborted.
+func (l *Log) abortExpired(now time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrLogClosed
+	}
+	var expired []string
+	for id, txn := range l.openTxns {
+		if now.Sub(txn.begun) > l.Config.Transactions.Timeout {
+			expired = append(expired, id)
+		}
+	}
+	sort.Strings(expired)
+	for i, id := range expired {
+		_, err := l.append(&api.Record{TransactionId: id, Marker: api.Marker_MARKER_ABORT})
+		if err != nil {
+			return i, err
+		}
+	}
+	if len(expired) > 0 && l.Config.Durability.SyncOnAppend {
+		return len(expired), l.activeSegment.Sync()
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,129 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// jsonValidator validates values against a JSON Schema.
+type jsonValidator struct {
+	schema *jsonschema.Schema
+}
+
+func compileJSON(s Schema) (*jsonValidator, error) {
+	url := fmt.Sprintf("%s.json", s.Subject)
+	schema, err := jsonschema.CompileString(url, s.Schema)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonValidator{schema: schema}, nil
+}
+
+func (v *jsonValidator) validate(value []byte) error {
+	d := json.NewDecoder(bytes.NewReader(value))
+	d.UseNumber()
+	var doc interface{}
+	err := d.Decode(&doc)
+	if err != nil {
+		return fmt.Errorf("not JSON: %v", err)
+	}
+	if d.More() {
+		return fmt.Errorf("not JSON: data after the value")
+	}
+	return v.schema.Validate(doc)
+}
+
+// compatible checks the keywords that most often break old values: types,
+// required properties, closed objects and enums. It checks properties and
+// items recursively, but not combinators such as allOf or references.
+func (v *jsonValidator) compatible(prev validator) error {
+	p, ok := prev.(*jsonValidator)
+	if !ok {
+		return fmt.Errorf("previous version isn't a JSON schema")
+	}
+	return compatibleJSON(p.schema, v.schema, "#")
+}
+
+func compatibleJSON(prev, next *jsonschema.Schema, path string) error {
+	if prev == nil || next == nil {
+		return nil
+	}
+	if len(next.Types) > 0 {
+		if len(prev.Types) == 0 {
+			return fmt.Errorf("%s: type restricted to %v", path, next.Types)
+		}
+		for _, t := range prev.Types {
+			if !containsType(next.Types, t) {
+				return fmt.Errorf("%s: type %s no longer allowed", path, t)
+			}
+		}
+	}
+	for _, name := range next.Required {
+		if !contains(prev.Required, name) {
+			return fmt.Errorf("%s: property %s is newly required", path, name)
+		}
+	}
+	if closed(next.AdditionalProperties) {
+		if !closed(prev.AdditionalProperties) {
+			return fmt.Errorf("%s: additional properties no longer allowed", path)
+		}
+		for name := range prev.Properties {
+			if _, ok := next.Properties[name]; !ok {
+				return fmt.Errorf("%s: property %s no longer allowed", path, name)
+			}
+		}
+	}
+	if next.Enum != nil {
+		for _, e := range prev.Enum {
+			if !containsValue(next.Enum, e) {
+				return fmt.Errorf("%s: enum value %v no longer allowed", path, e)
+			}
+		}
+		if prev.Enum == nil {
+			return fmt.Errorf("%s: values restricted to an enum", path)
+		}
+	}
+	for name, p := range next.Properties {
+		err := compatibleJSON(prev.Properties[name], p, path+"/properties/"+name)
+		if err != nil {
+			return err
+		}
+	}
+	prevItems, _ := prev.Items.(*jsonschema.Schema)
+	nextItems, _ := next.Items.(*jsonschema.Schema)
+	return compatibleJSON(prevItems, nextItems, path+"/items")
+}
+
+// closed reports whether additionalProperties disallows any.
+func closed(additional interface{}) bool {
+	b, ok := additional.(bool)
+	return ok && !b
+}
+
+// containsType reports whether types allows t, counting integers as numbers.
+func containsType(types []string, t string) bool {
+	return contains(types, t) || t == "integer" && contains(types, "number")
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsValue(s []interface{}, v interface{}) bool {
+	b, _ := json.Marshal(v)
+	for _, e := range s {
+		eb, _ := json.Marshal(e)
+		if bytes.Equal(b, eb) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package schema
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protobufValidator validates values against a protobuf message descriptor.
+type protobufValidator struct {
+	message protoreflect.MessageDescriptor
+}
+
+func compileProtobuf(s Schema) (*protobufValidator, error) {
+	if s.Message == "" {
+		return nil, fmt.Errorf("message must be set")
+	}
+	b, err := base64.StdEncoding.DecodeString(s.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set isn't base64: %v", err)
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	err = proto.Unmarshal(b, set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set: %v", err)
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set: %v", err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(s.Message))
+	if err != nil {
+		return nil, fmt.Errorf("message %s: %v", s.Message, err)
+	}
+	message, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't a message", s.Message)
+	}
+	return &protobufValidator{message: message}, nil
+}
+
+// validate checks the value decodes as the message without unknown fields,
+// since nearly any bytes decode as some message's unknown fields. Fields with
+// reserved numbers, which earlier versions may have written, are allowed.
+func (v *protobufValidator) validate(value []byte) error {
+	m := dynamicpb.NewMessage(v.message)
+	err := proto.Unmarshal(value, m)
+	if err != nil {
+		return err
+	}
+	return checkUnknown(m)
+}
+
+// checkUnknown returns an error if the message or any message in it has
+// unknown fields whose numbers aren't reserved.
+func checkUnknown(m protoreflect.Message) error {
+	d := m.Descriptor()
+	b := m.GetUnknown()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if !d.ReservedRanges().Has(num) {
+			return fmt.Errorf("unknown field %d in %s", num, d.FullName())
+		}
+	}
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := v.List()
+			for i := 0; i < list.Len() && err == nil; i++ {
+				err = checkUnknown(list.Get(i).Message())
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			v.Map().Range(func(_ protoreflect.MapKey, v protoreflect.Value) bool {
+				err = checkUnknown(v.Message())
+				return err == nil
+			})
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil:
+			err = checkUnknown(v.Message())
+		}
+		return err == nil
+	})
+	return err
+}
+
+// compatible checks that the fields the message kept, by number, have the
+// same kind and cardinality, recursing into message fields. A removed field's
+// number must be reserved, since old values still hold it and validate only
+// allows unknown fields with reserved numbers.
+func (v *protobufValidator) compatible(prev validator) error {
+	p, ok := prev.(*protobufValidator)
+	if !ok {
+		return fmt.Errorf("previous version isn't a protobuf schema")
+	}
+	if p.message.FullName() != v.message.FullName() {
+		return fmt.Errorf("message changed from %s to %s", p.message.FullName(), v.message.FullName())
+	}
+	return compatibleMessage(p.message, v.message, map[protoreflect.FullName]bool{})
+}
+
+func compatibleMessage(prev, next protoreflect.MessageDescriptor, seen map[protoreflect.FullName]bool) error {
+	if seen[next.FullName()] {
+		return nil
+	}
+	seen[next.FullName()] = true
+	fields := prev.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		pf := fields.Get(i)
+		nf := next.Fields().ByNumber(pf.Number())
+		if nf == nil {
+			if !next.ReservedRanges().Has(pf.Number()) {
+				return fmt.Errorf("%s field %d: removed without reserving its number",
+					next.FullName(), pf.Number())
+			}
+			continue
+		}
+		switch {
+		case pf.Kind() != nf.Kind():
+			return fmt.Errorf("%s field %d: kind changed from %s to %s",
+				next.FullName(), pf.Number(), pf.Kind(), nf.Kind())
+		case pf.Cardinality() != nf.Cardinality():
+			return fmt.Errorf("%s field %d: cardinality changed from %s to %s",
+				next.FullName(), pf.Number(), pf.Cardinality(), nf.Cardinality())
+		case pf.Message() != nil:
+			err := compatibleMessage(pf.Message(), nf.Message(), seen)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+// Package schema is a registry of the schemas records' values must match.
+//
+// Schemas are registered under a subject, the topic whose records they
+// describe, and each subject's schemas are numbered as versions from 1. A new
+// version must be compatible with the one before it, so consumers that
+// understand the new version can read records written with the old one.
+// Registrations are appended to the registry's own log, and each schema's ID
+// is the offset it was written at.
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/internal/log"
+)
+
+// Type is the language a schema is written in.
+type Type string
+
+const (
+	// JSON schemas are JSON Schema documents that values must be JSON
+	// matching.
+	JSON Type = "JSON"
+	// Protobuf schemas are base64-encoded FileDescriptorSets, as written by
+	// protoc --descriptor_set_out, along with the name of the message that
+	// values must be the binary encoding of.
+	Protobuf Type = "PROTOBUF"
+)
+
+// Compatibility is the check a subject's new versions must pass.
+type Compatibility string
+
+const (
+	// Backward requires values valid under the previous version to be valid
+	// under the new one.
+	Backward Compatibility = "BACKWARD"
+	// None allows any change.
+	None Compatibility = "NONE"
+)
+
+var (
+	// ErrNotFound is returned for subjects, versions and IDs that haven't
+	// been registered.
+	ErrNotFound = errors.New("schema not found")
+	// ErrInvalidSchema is returned when registering a schema that can't be
+	// compiled.
+	ErrInvalidSchema = errors.New("invalid schema")
+	// ErrIncompatible is returned when registering a version that isn't
+	// compatible with the one before it.
+	ErrIncompatible = errors.New("incompatible schema")
+	// ErrInvalidValue is returned when a value doesn't match its schema.
+	ErrInvalidValue = errors.New("value doesn't match schema")
+)
+
+// Schema is a registered version of a subject's schema.
+type Schema struct {
+	ID      uint64 `json:"id"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+	Type    Type   `json:"type"`
+	Schema  string `json:"schema"`
+	// Message is the full name of the protobuf message values are.
+	Message string `json:"message,omitempty"`
+}
+
+// Config configures a Registry.
+type Config struct {
+	// Compatibility is the check new versions must pass. Defaults to
+	// Backward.
+	Compatibility Compatibility
+	// Log configures the log schemas are stored in. Its segments default
+	// to 1MiB, since a segment holds records no larger than itself.
+	Log log.Config
+}
+
+// Registry holds the registered schemas. It's safe for concurrent use.
+type Registry struct {
+	mu       sync.RWMutex
+	config   Config
+	log      *log.Log
+	ids      map[uint64]*registered
+	subjects map[string][]*registered
+}
+
+// registered is a schema along with its compiled form.
+type registered struct {
+	schema    Schema
+	validator validator
+}
+
+// validator checks values against a compiled schema.
+type validator interface {
+	// validate returns an error describing why the value doesn't match.
+	validate(value []byte) error
+	// compatible returns an error describing why values valid under prev,
+	// the subject's previous version, wouldn't be valid under this version.
+	compatible(prev validator) error
+}
+
+// NewRegistry opens the registry stored in dir, creating it if need be.
+func NewRegistry(dir string, c Config) (*Registry, error) {
+	if c.Compatibility == "" {
+		c.Compatibility = Backward
+	}
+	if c.Compatibility != Backward && c.Compatibility != None {
+		return nil, fmt.Errorf("unknown compatibility %q", c.Compatibility)
+	}
+	if c.Log.Segment.MaxStoreBytes == 0 {
+		c.Log.Segment.MaxStoreBytes = 1 << 20
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	l, err := log.NewLog(dir, c.Log)
+	if err != nil {
+		return nil, err
+	}
+	r := &Registry{
+		config:   c,
+		log:      l,
+		ids:      make(map[uint64]*registered),
+		subjects: make(map[string][]*registered),
+	}
+	err = r.load()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// load compiles the schemas stored in the log.
+func (r *Registry) load() error {
+	records, _, err := r.log.Scan(0, int(^uint(0)>>1), log.ReadUncommitted)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		var s Schema
+		err = json.Unmarshal(record.Value, &s)
+		if err != nil {
+			return fmt.Errorf("schema at offset %d: %v", record.Offset, err)
+		}
+		s.ID = record.Offset
+		v, err := compile(s)
+		if err != nil {
+			return fmt.Errorf("schema at offset %d: %v", record.Offset, err)
+		}
+		r.add(&registered{schema: s, validator: v})
+	}
+	return nil
+}
+
+func (r *Registry) add(s *registered) {
+	r.ids[s.schema.ID] = s
+	r.subjects[s.schema.Subject] = append(r.subjects[s.schema.Subject], s)
+}
+
+// Register adds the schema as the subject's next version and returns it with
+// its ID and version set. Registering the subject's latest schema again
+// returns the latest version rather than adding another.
+func (r *Registry) Register(s Schema) (Schema, error) {
+	if s.Subject == "" {
+		return Schema{}, fmt.Errorf("%w: subject must be set", ErrInvalidSchema)
+	}
+	v, err := compile(s)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions := r.subjects[s.Subject]
+	s.Version = len(versions) + 1
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		prev := latest.schema
+		if prev.Type == s.Type && prev.Schema == s.Schema && prev.Message == s.Message {
+			return prev, nil
+		}
+		if r.config.Compatibility == Backward {
+			if prev.Type != s.Type {
+				return Schema{}, fmt.Errorf("%w: type changed from %s to %s", ErrIncompatible, prev.Type, s.Type)
+			}
+			err = v.compatible(latest.validator)
+			if err != nil {
+				return Schema{}, fmt.Errorf("%w with version %d: %v", ErrIncompatible, prev.Version, err)
+			}
+		}
+	}
+
+	// the ID is the offset the schema is written at, which we only know once
+	// it's written, so it's stored without one and set when it's read back
+	b, err := json.Marshal(s)
+	if err != nil {
+		return Schema{}, err
+	}
+	off, err := r.log.Append(&api.Record{Value: b, Key: []byte(s.Subject)})
+	if err != nil {
+		return Schema{}, err
+	}
+	s.ID = off
+	r.add(&registered{schema: s, validator: v})
+	return s, nil
+}
+
+// Get returns the schema with the given ID.
+func (r *Registry) Get(id uint64) (Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.ids[id]
+	if !ok {
+		return Schema{}, fmt.Errorf("%w: id %d", ErrNotFound, id)
+	}
+	return s.schema, nil
+}
+
+// Version returns the subject's schema with the given version, or its latest
+// if version is 0.
+func (r *Registry) Version(subject string, version int) (Schema, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, err := r.version(subject, version)
+	if err != nil {
+		return Schema{}, err
+	}
+	return s.schema, nil
+}
+
+func (r *Registry) version(subject string, version int) (*registered, error) {
+	versions := r.subjects[subject]
+	if version == 0 {
+		version = len(versions)
+	}
+	if version < 1 || version > len(versions) {
+		return nil, fmt.Errorf("%w: subject %s version %d", ErrNotFound, subject, version)
+	}
+	return versions[version-1], nil
+}
+
+// Versions returns the subject's schemas, oldest first.
+func (r *Registry) Versions(subject string) []Schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	schemas := make([]Schema, 0, len(r.subjects[subject]))
+	for _, s := range r.subjects[subject] {
+		schemas = append(schemas, s.schema)
+	}
+	return schemas
+}
+
+// Validate checks the value against the schema with the given ID, or the
+// subject's latest schema if id is nil, and returns the ID of the schema it
+// matched. It returns ErrNotFound if the subject has no schemas, or if the ID
+// isn't one of the subject's.
+func (r *Registry) Validate(subject string, id *uint64, value []byte) (uint64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var s *registered
+	if id == nil {
+		var err error
+		s, err = r.version(subject, 0)
+		if err != nil {
+			return 0, err
+		}
+	} else {
+		s = r.ids[*id]
+		if s == nil || s.schema.Subject != subject {
+			return 0, fmt.Errorf("%w: subject %s id %d", ErrNotFound, subject, *id)
+		}
+	}
+	err := s.validator.validate(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w %d: %v", ErrInvalidValue, s.schema.ID, err)
+	}
+	return s.schema.ID, nil
+}
+
+// Close closes the registry's log.
+func (r *Registry) Close() error {
+	return r.log.Close()
+}
+
+// compile compiles the schema into its validator.
+func compile(s Schema) (validator, error) {
+	var v validator
+	var err error
+	switch s.Type {
+	case JSON:
+		v, err = compileJSON(s)
+	case Protobuf:
+		v, err = compileProtobuf(s)
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidSchema, s.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	return v, nil
+}
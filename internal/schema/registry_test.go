@@ -0,0 +1,181 @@
+package schema
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestRegistry(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, r *Registry,
+	){
+		"json schema versions":     testJSONSchema,
+		"protobuf schema versions": testProtobufSchema,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "schema-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			r, err := NewRegistry(dir, Config{})
+			require.NoError(t, err)
+			defer r.Close()
+			fn(t, r)
+		})
+	}
+}
+
+const userV1 = `{
+	"type": "object",
+	"properties": {"name": {"type": "string"}},
+	"required": ["name"]
+}`
+
+const userV2 = `{
+	"type": "object",
+	"properties": {"name": {"type": "string"}, "age": {"type": "integer"}},
+	"required": ["name"]
+}`
+
+func testJSONSchema(t *testing.T, r *Registry) {
+	v1, err := r.Register(Schema{Subject: "users", Type: JSON, Schema: userV1})
+	require.NoError(t, err)
+	require.Equal(t, 1, v1.Version)
+	again, err := r.Register(Schema{Subject: "users", Type: JSON, Schema: userV1})
+	require.NoError(t, err)
+	require.Equal(t, v1, again)
+
+	v2, err := r.Register(Schema{Subject: "users", Type: JSON, Schema: userV2})
+	require.NoError(t, err)
+	require.Equal(t, 2, v2.Version)
+	require.NotEqual(t, v1.ID, v2.ID)
+
+	// requiring age would reject users written with version 2
+	_, err = r.Register(Schema{Subject: "users", Type: JSON, Schema: `{
+		"type": "object",
+		"properties": {"name": {"type": "string"}, "age": {"type": "integer"}},
+		"required": ["name", "age"]
+	}`})
+	require.True(t, errors.Is(err, ErrIncompatible), "%v", err)
+	_, err = r.Register(Schema{Subject: "users", Type: JSON, Schema: `{"type": `})
+	require.True(t, errors.Is(err, ErrInvalidSchema), "%v", err)
+
+	id, err := r.Validate("users", nil, []byte(`{"name": "ada", "age": 36}`))
+	require.NoError(t, err)
+	require.Equal(t, v2.ID, id)
+	_, err = r.Validate("users", nil, []byte(`{"name": "ada", "age": "old"}`))
+	require.True(t, errors.Is(err, ErrInvalidValue), "%v", err)
+	_, err = r.Validate("users", nil, []byte(`not json`))
+	require.True(t, errors.Is(err, ErrInvalidValue), "%v", err)
+	id, err = r.Validate("users", &v1.ID, []byte(`{"name": "ada"}`))
+	require.NoError(t, err)
+	require.Equal(t, v1.ID, id)
+	_, err = r.Validate("orders", nil, []byte(`{}`))
+	require.True(t, errors.Is(err, ErrNotFound), "%v", err)
+
+	// the registry is rebuilt from its log
+	require.NoError(t, r.Close())
+	r, err = NewRegistry(r.log.Dir, r.config)
+	require.NoError(t, err)
+	defer r.Close()
+	latest, err := r.Version("users", 0)
+	require.NoError(t, err)
+	require.Equal(t, v2, latest)
+	got, err := r.Get(v1.ID)
+	require.NoError(t, err)
+	require.Equal(t, v1, got)
+	require.Equal(t, []Schema{v1, v2}, r.Versions("users"))
+}
+
+// recordDescriptors returns the descriptor set for api.Record, after letting
+// edit change its file.
+func recordDescriptors(t *testing.T, edit func(*descriptorpb.FileDescriptorProto)) string {
+	file := protodesc.ToFileDescriptorProto(api.File_api_v1_log_proto)
+	edit(file)
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(timestamppb.File_google_protobuf_timestamp_proto),
+		file,
+	}}
+	b, err := proto.Marshal(set)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func testProtobufSchema(t *testing.T, r *Registry) {
+	unchanged := func(*descriptorpb.FileDescriptorProto) {}
+	v1, err := r.Register(Schema{
+		Subject: "records",
+		Type:    Protobuf,
+		Schema:  recordDescriptors(t, unchanged),
+		Message: "log.v1.Record",
+	})
+	require.NoError(t, err)
+
+	value, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: 7})
+	require.NoError(t, err)
+	id, err := r.Validate("records", nil, value)
+	require.NoError(t, err)
+	require.Equal(t, v1.ID, id)
+	_, err = r.Validate("records", nil, []byte(`{"value": "hello world"}`))
+	require.True(t, errors.Is(err, ErrInvalidValue), "%v", err)
+
+	// changing the offset from a uint64 to a string breaks old records
+	_, err = r.Register(Schema{
+		Subject: "records",
+		Type:    Protobuf,
+		Schema: recordDescriptors(t, func(f *descriptorpb.FileDescriptorProto) {
+			f.MessageType[0].Field[1].Type = descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+		}),
+		Message: "log.v1.Record",
+	})
+	require.True(t, errors.Is(err, ErrIncompatible), "%v", err)
+
+	// removing the key breaks old records that have one, unless its number's
+	// reserved
+	removeKey := func(f *descriptorpb.FileDescriptorProto) int32 {
+		m := f.MessageType[0]
+		num := m.Field[2].GetNumber()
+		m.Field = append(m.Field[:2], m.Field[3:]...)
+		return num
+	}
+	_, err = r.Register(Schema{
+		Subject: "records",
+		Type:    Protobuf,
+		Schema: recordDescriptors(t, func(f *descriptorpb.FileDescriptorProto) {
+			removeKey(f)
+		}),
+		Message: "log.v1.Record",
+	})
+	require.True(t, errors.Is(err, ErrIncompatible), "%v", err)
+	v2, err := r.Register(Schema{
+		Subject: "records",
+		Type:    Protobuf,
+		Schema: recordDescriptors(t, func(f *descriptorpb.FileDescriptorProto) {
+			num := removeKey(f)
+			f.MessageType[0].ReservedRange = append(f.MessageType[0].ReservedRange,
+				&descriptorpb.DescriptorProto_ReservedRange{Start: proto.Int32(num), End: proto.Int32(num + 1)})
+		}),
+		Message: "log.v1.Record",
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, v2.Version)
+
+	// a record with a key still validates, but other unknown fields don't
+	value, err = proto.Marshal(&api.Record{Value: []byte("hello world"), Key: []byte("key")})
+	require.NoError(t, err)
+	id, err = r.Validate("records", nil, value)
+	require.NoError(t, err)
+	require.Equal(t, v2.ID, id)
+	_, err = r.Validate("records", nil, protowire.AppendVarint(protowire.AppendTag(nil, 1000, protowire.VarintType), 1))
+	require.True(t, errors.Is(err, ErrInvalidValue), "%v", err)
+}
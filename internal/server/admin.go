@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/andrwkng/proglog/internal/log"
+)
+
+// SnapshotResponse describes a snapshot written by POST /admin/snapshot.
+type SnapshotResponse struct {
+	Dir      string            `json:"dir"`
+	Segments []log.SegmentInfo `json:"segments"`
+}
+
+// RotateKeyResponse names the key POST /admin/rotate-key made active.
+type RotateKeyResponse struct {
+	KeyID string `json:"key_id"`
+}
+
+// handleBackup streams a tar archive of the log's segments as they were
+// when the request was made. Appends aren't held up while it's sent.
+func (s *httpServer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="proglog-backup.tar"`)
+	_, err := s.Log.Backup(w)
+	if err != nil {
+		// the archive may be partly written, so all we can do is cut it short
+		// and let the restore fail on the missing manifest
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleSnapshot writes a snapshot of the log into a new, timestamped
+// directory under the snapshot dir while appends carry on.
+func (s *httpServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if s.snapshotDir == "" {
+		http.Error(w, "snapshots are disabled", http.StatusNotFound)
+		return
+	}
+	dir := filepath.Join(s.snapshotDir, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	segments, err := s.Log.Snapshot(dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res := SnapshotResponse{Dir: dir, Segments: segments}
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleRotateKey makes a new key the one the log's new segments are
+// encrypted with. Older segments are re-encrypted in the background.
+func (s *httpServer) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+	id, err := s.Log.RotateKey()
+	if errors.Is(err, log.ErrNotEncrypted) {
+		http.Error(w, "encryption is disabled", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = json.NewEncoder(w).Encode(RotateKeyResponse{KeyID: id})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
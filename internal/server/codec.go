@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The media types records can be sent and received as. JSON base64-encodes
+// values; protobuf is api.Record's own encoding; octet-stream is the bare
+// value, with the offset in the OffsetHeader when responding.
+const (
+	mediaJSON        = "application/json"
+	mediaProtobuf    = "application/x-protobuf"
+	mediaOctetStream = "application/octet-stream"
+)
+
+// OffsetHeader holds the record's offset in octet-stream responses, which
+// have nowhere else to put it.
+const OffsetHeader = "Proglog-Offset"
+
+// MediaFrames is the media type of GET /records/frames responses: records as
+// the log stores them, each an 8-byte big-endian length followed by that many
+// bytes of a protobuf-encoded api.Record.
+const MediaFrames = "application/x-proglog-frames"
+
+// NextOffsetHeader holds the offset after the last record in a
+// GET /records/frames response, to request the next run from.
+const NextOffsetHeader = "Proglog-Next-Offset"
+
+// Record is the JSON form of an api.Record.
+type Record struct {
+	Value         []byte            `json:"value"`
+	Offset        uint64            `json:"offset"`
+	Key           []byte            `json:"key,omitempty"`
+	ProduceTime   *time.Time        `json:"produce_time,omitempty"`
+	AppendTime    *time.Time        `json:"append_time,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	ProducerID    string            `json:"producer_id,omitempty"`
+	Sequence      uint64            `json:"sequence,omitempty"`
+	TransactionID string            `json:"transaction_id,omitempty"`
+	Marker        string            `json:"marker,omitempty"` // begin, commit or abort
+}
+
+// newRecord returns the JSON form of record.
+func newRecord(record *api.Record) Record {
+	r := Record{
+		Value:         record.Value,
+		Offset:        record.Offset,
+		Key:           record.Key,
+		Headers:       record.Headers,
+		ProducerID:    record.ProducerId,
+		Sequence:      record.Sequence,
+		TransactionID: record.TransactionId,
+	}
+	if record.Marker != api.Marker_MARKER_NONE {
+		r.Marker = strings.ToLower(strings.TrimPrefix(record.Marker.String(), "MARKER_"))
+	}
+	if record.ProduceTime != nil {
+		t := record.ProduceTime.AsTime()
+		r.ProduceTime = &t
+	}
+	if record.AppendTime != nil {
+		t := record.AppendTime.AsTime()
+		r.AppendTime = &t
+	}
+	return r
+}
+
+// apiRecord returns the record to append for r. The offset and append time
+// are the log's to set, and markers are appended through /transactions, so
+// they're left out.
+func (r Record) apiRecord() *api.Record {
+	record := &api.Record{
+		Value:         r.Value,
+		Key:           r.Key,
+		Headers:       r.Headers,
+		ProducerId:    r.ProducerID,
+		Sequence:      r.Sequence,
+		TransactionId: r.TransactionID,
+	}
+	if r.ProduceTime != nil {
+		record.ProduceTime = timestamppb.New(*r.ProduceTime)
+	}
+	return record
+}
+
+var errNotAcceptable = errors.New("none of the accepted media types can be produced")
+
+// limitBody makes reading more than the server's max body size from r's body
+// fail, rather than buffering as much as the client sends.
+func (s *httpServer) limitBody(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+}
+
+// bodyErrorStatus returns the status to respond with when a request body
+// couldn't be read or decoded: 413 Request Entity Too Large if it was over the
+// max body size, otherwise 400 Bad Request.
+func bodyErrorStatus(err error) int {
+	// http.MaxBytesReader's error has no type of its own to check for
+	if strings.HasSuffix(err.Error(), "request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// contentType returns the media type of r's body, without its parameters. A
+// request without a Content-Type is taken to be JSON.
+func contentType(r *http.Request) (string, error) {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return mediaJSON, nil
+	}
+	media, _, err := mime.ParseMediaType(ct)
+	return media, err
+}
+
+// decodeRecord reads the record in r's body, encoded as the media type, which
+// is r's parsed Content-Type.
+func decodeRecord(r *http.Request, media string) (*api.Record, int, error) {
+	switch media {
+	case mediaJSON:
+		var record Record
+		err := json.NewDecoder(r.Body).Decode(&record)
+		if err != nil {
+			return nil, bodyErrorStatus(err), err
+		}
+		return record.apiRecord(), 0, nil
+	case mediaProtobuf, mediaOctetStream:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, bodyErrorStatus(err), err
+		}
+		if media == mediaOctetStream {
+			return &api.Record{Value: b}, 0, nil
+		}
+		record := &api.Record{}
+		err = proto.Unmarshal(b, record)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		record.Offset = 0
+		record.AppendTime = nil
+		record.Marker = api.Marker_MARKER_NONE
+		return record, 0, nil
+	}
+	return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", media)
+}
+
+// negotiate returns which of the offered media types to respond to r with:
+// the one its Accept header prefers, or the first offered if it doesn't say.
+func negotiate(r *http.Request, offered ...string) (string, error) {
+	accept := r.Header.Values("Accept")
+	if len(accept) == 0 {
+		return offered[0], nil
+	}
+
+	type accepted struct {
+		media string
+		q     float64
+	}
+	var ranges []accepted
+	for _, v := range accept {
+		for _, part := range strings.Split(v, ",") {
+			media, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				q, err = strconv.ParseFloat(v, 64)
+				if err != nil {
+					continue
+				}
+			}
+			if q > 0 {
+				ranges = append(ranges, accepted{media, q})
+			}
+		}
+	}
+	// stable, so equally preferred types keep the client's order
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+
+	for _, a := range ranges {
+		for _, media := range offered {
+			if a.media == media || a.media == "*/*" ||
+				a.media == "application/*" && strings.HasPrefix(media, "application/") {
+				return media, nil
+			}
+		}
+	}
+	return "", errNotAcceptable
+}
+
+// writeRecord responds with the record encoded as media.
+func writeRecord(w http.ResponseWriter, media string, record *api.Record) error {
+	w.Header().Set("Content-Type", media)
+	switch media {
+	case mediaProtobuf:
+		b, err := proto.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	case mediaOctetStream:
+		w.Header().Set(OffsetHeader, strconv.FormatUint(record.Offset, 10))
+		_, err := w.Write(record.Value)
+		return err
+	}
+	return json.NewEncoder(w).Encode(newRecord(record))
+}
+
+// writeRecords responds with the records encoded as media, which can't be
+// octet-stream since a bare value can't be told from the next.
+func writeRecords(w http.ResponseWriter, media string, records []*api.Record) error {
+	w.Header().Set("Content-Type", media)
+	if media == mediaProtobuf {
+		b, err := proto.Marshal(&api.Records{Records: records})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	res := RangeResponse{Records: []Record{}}
+	for _, record := range records {
+		res.Records = append(res.Records, newRecord(record))
+	}
+	return json.NewEncoder(w).Encode(res)
+}
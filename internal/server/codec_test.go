@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestContentNegotiation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "codec-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{CommitLog: clog}).Handler)
+	defer srv.Close()
+
+	value := []byte{0, 1, 2, 0xff}
+	pb, err := proto.Marshal(&api.Record{Value: value})
+	require.NoError(t, err)
+	for i, body := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{"application/json", []byte(`{"value":"AAEC/w=="}`)},
+		{"application/x-protobuf", pb},
+		{"application/octet-stream", value},
+	} {
+		resp, err := http.Post(srv.URL+"/records", body.contentType, bytes.NewReader(body.body))
+		require.NoError(t, err)
+		var res ProduceResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode, body.contentType)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+
+	resp, err := http.Post(srv.URL+"/records", "text/plain", strings.NewReader("hi"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	get := func(path, accept string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", accept)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	for off := 0; off < 3; off++ {
+		path := fmt.Sprintf("/records/%d", off)
+
+		resp = get(path, "application/json")
+		var record Record
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&record))
+		resp.Body.Close()
+		require.Equal(t, value, record.Value)
+
+		resp = get(path, "application/json;q=0.5, application/x-protobuf")
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, "application/x-protobuf", resp.Header.Get("Content-Type"))
+		got := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b, got))
+		require.Equal(t, value, got.Value)
+		require.Equal(t, uint64(off), got.Offset)
+
+		resp = get(path, "application/octet-stream")
+		b, err = ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, value, b)
+		require.Equal(t, fmt.Sprint(off), resp.Header.Get(OffsetHeader))
+	}
+
+	resp = get("/records?from=1", "application/x-protobuf")
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	records := &api.Records{}
+	require.NoError(t, proto.Unmarshal(b, records))
+	require.Len(t, records.Records, 2)
+	require.Equal(t, uint64(2), records.Records[1].Offset)
+
+	// a range of bare values couldn't be split up again
+	resp = get("/records", "application/octet-stream")
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotAcceptable, resp.StatusCode)
+
+	// the original endpoint takes a JSON ProduceRequest by its parsed media
+	// type, so parameters are allowed but lookalike types aren't
+	for contentType, status := range map[string]int{
+		"application/json; charset=utf-8": http.StatusOK,
+		"application/jsonl":               http.StatusUnsupportedMediaType,
+		"application/json; =":             http.StatusUnsupportedMediaType,
+	} {
+		resp, err = http.Post(srv.URL+"/", contentType, strings.NewReader(`{"record":{"value":"aGk="}}`))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, status, resp.StatusCode, contentType)
+	}
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// handleHealthz reports that the process is up and serving requests.
+func (s *httpServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the log is open and accepting appends, so load
+// balancers stop routing produce requests to a server that can't take them.
+func (s *httpServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	err := s.Log.Writable()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
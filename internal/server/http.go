@@ -2,8 +2,13 @@ package server
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
+	"sync"
 
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/internal/log"
+	"github.com/andrwkng/proglog/internal/schema"
 	"github.com/gorilla/mux"
 )
 
@@ -23,38 +28,160 @@ type ConsumeResponse struct {
 	Record Record `json:"record"`
 }
 
-func NewHTTPServer(addr string) *http.Server {
-	s := newHTTPServer()
-	r := mux.NewRouter()
+// CommitLog is the log the server appends records to and reads them from.
+type CommitLog interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
+	// ReadIsolated reads a record, failing with log.ErrNotCommitted if
+	// reading committed and a committed scan would leave it out.
+	ReadIsolated(off uint64, isolation log.Isolation) (*api.Record, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	// Scan reads a range of records, leaving out transaction markers and,
+	// when reading committed, aborted and open transactions' records. It
+	// returns the offset to scan from next.
+	Scan(from uint64, max int, isolation log.Isolation) ([]*api.Record, uint64, error)
+	// ReadFrames reads a range of records as the frames they're stored in.
+	ReadFrames(from uint64, max int) (*log.Frames, error)
+	// Begin, Commit and Abort append transaction markers.
+	Begin(id string) (uint64, error)
+	Commit(id string) (uint64, error)
+	Abort(id string) (uint64, error)
+	// Appended returns a channel that's closed once a record is appended.
+	Appended() <-chan struct{}
+	// Writable returns nil if the log can accept appends.
+	Writable() error
+	// Backup writes an archive of the log's segments to w.
+	Backup(w io.Writer) (*log.Manifest, error)
+	// Snapshot writes a copy of the log's segments to dir.
+	Snapshot(dir string) ([]log.SegmentInfo, error)
+	// RotateKey makes a new key the one new segments are encrypted with.
+	RotateKey() (string, error)
+}
+
+// Config configures the HTTP server.
+type Config struct {
+	CommitLog CommitLog
+	// SnapshotDir is the directory POST /admin/snapshot writes snapshots
+	// into. Snapshots are disabled if it's empty.
+	SnapshotDir string
+	// Schemas validates produced records against their topic's schema. The
+	// registry is disabled if it's nil.
+	Schemas *schema.Registry
+	// Quotas limits the rates clients produce and consume at. If it's nil,
+	// clients are metered but not limited.
+	Quotas *QuotaConfig
+	// MaxRecordBytes is the size of the largest record the log accepts.
+	// Request bodies more than twice that, which leaves room for JSON's
+	// base64-encoded values, are refused with 413 Request Entity Too Large.
+	// 1MiB by default.
+	MaxRecordBytes uint64
+	// AllowedOrigins are the origins, like https://dashboard.example.com,
+	// whose pages may stream records over a WebSocket besides the server's
+	// own.
+	AllowedOrigins []string
+}
 
-	r.HandleFunc("/", s.handleProduce).Methods("POST")
-	r.HandleFunc("/", s.handleConsume).Methods("GET")
+func NewHTTPServer(addr string, config *Config) *http.Server {
+	s := newHTTPServer(config)
+	r := mux.NewRouter()
 
-	return &http.Server{
+	r.HandleFunc("/", s.limit(opProduce, s.handleProduce)).Methods("POST")
+	r.HandleFunc("/", s.limit(opConsume, s.handleConsume)).Methods("GET")
+	r.HandleFunc("/records", s.limit(opProduce, s.handleCreateRecord)).Methods("POST")
+	r.HandleFunc("/records", s.limit(opConsume, s.handleGetRecords)).Methods("GET")
+	r.HandleFunc("/records/{offset:[0-9]+}", s.limit(opConsume, s.handleGetRecord)).Methods("GET")
+	r.HandleFunc("/records/frames", s.limit(opConsume, s.handleGetFrames)).Methods("GET")
+	r.HandleFunc("/records/events", s.limit(opConsume, s.handleEvents)).Methods("GET")
+	r.HandleFunc("/records/ws", s.limit(opConsume, s.handleWebSocket)).Methods("GET")
+	r.HandleFunc("/transactions/{id}/{action:begin|commit|abort}", s.limit(opProduce, s.handleTransaction)).Methods("POST")
+	r.HandleFunc("/subjects/{subject}/versions", s.limit(opProduce, s.handleRegisterSchema)).Methods("POST")
+	r.HandleFunc("/subjects/{subject}/versions", s.limit(opConsume, s.handleGetSchemaVersions)).Methods("GET")
+	r.HandleFunc("/subjects/{subject}/versions/{version:[0-9]+|latest}", s.limit(opConsume, s.handleGetSchemaVersion)).Methods("GET")
+	r.HandleFunc("/schemas/ids/{id:[0-9]+}", s.limit(opConsume, s.handleGetSchema)).Methods("GET")
+	r.HandleFunc("/healthz", s.handleHealthz).Methods("GET")
+	r.HandleFunc("/readyz", s.handleReadyz).Methods("GET")
+	r.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
+	r.HandleFunc("/admin/backup", s.limit(opConsume, s.handleBackup)).Methods("GET")
+	r.HandleFunc("/admin/snapshot", s.limit(opProduce, s.handleSnapshot)).Methods("POST")
+	r.HandleFunc("/admin/rotate-key", s.limit(opProduce, s.handleRotateKey)).Methods("POST")
+
+	srv := &http.Server{
 		Addr:    addr,
 		Handler: r,
 	}
+	// streams never go idle, so end them rather than have Shutdown wait
+	srv.RegisterOnShutdown(s.closeStreams)
+	return srv
 }
 
 type httpServer struct {
-	Log *Log
+	Log         CommitLog
+	snapshotDir string
+	schemas     *schema.Registry
+	quotas      *quotas
+	// maxBodyBytes is how much of a request body is read before it's refused
+	maxBodyBytes   int64
+	allowedOrigins []string
+
+	// shutdown is closed when the server shuts down, ending any streams
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
-func newHTTPServer() *httpServer {
-	return &httpServer{Log: NewLog()}
+func newHTTPServer(config *Config) *httpServer {
+	maxRecordBytes := config.MaxRecordBytes
+	if maxRecordBytes == 0 {
+		maxRecordBytes = 1 << 20
+	}
+	return &httpServer{
+		Log:            config.CommitLog,
+		snapshotDir:    config.SnapshotDir,
+		schemas:        config.Schemas,
+		quotas:         newQuotas(config.Quotas),
+		maxBodyBytes:   int64(2 * maxRecordBytes),
+		allowedOrigins: config.AllowedOrigins,
+		shutdown:       make(chan struct{}),
+	}
 }
 
+// handleProduce appends the record in a JSON ProduceRequest or, if the
+// Content-Type says so, a protobuf record or a bare octet-stream value.
 func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
-	var req ProduceRequest
-	err := json.NewDecoder(r.Body).Decode(&req)
+	s.limitBody(w, r)
+	media, err := contentType(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
 		return
 	}
+	var record *api.Record
+	switch media {
+	case mediaJSON:
+		var req ProduceRequest
+		err = json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), bodyErrorStatus(err))
+			return
+		}
+		record = req.Record.apiRecord()
+	default:
+		var status int
+		record, status, err = decodeRecord(r, media)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
 
-	off, err := s.Log.Append(req.Record)
+	status, err := s.validate(record)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	off, err := s.Log.Append(record)
+	if err != nil {
+		http.Error(w, err.Error(), appendErrorStatus(err))
 		return
 	}
 
@@ -67,25 +194,37 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// handleConsume responds with the record at the offset in the JSON
+// ConsumeRequest, as a JSON ConsumeResponse or, if the Accept header prefers
+// it, a protobuf record or its bare value.
 func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
+	s.limitBody(w, r)
 	var req ConsumeRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	media, err := negotiate(r, mediaJSON, mediaProtobuf, mediaOctetStream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
 		return
 	}
+
+	record, err := s.Log.Read(req.Offset)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), readErrorStatus(err))
 		return
 	}
 
-	res := ConsumeResponse{Record: record}
+	if media != mediaJSON {
+		err = writeRecord(w, media, record)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	res := ConsumeResponse{Record: newRecord(record)}
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
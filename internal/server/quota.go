@@ -0,0 +1,364 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// APIKeyHeader is the request header a client sends its API key in.
+const APIKeyHeader = "Proglog-Api-Key"
+
+// anonymous is the client requests that don't identify one are counted
+// against.
+const anonymous = "anonymous"
+
+// Quota limits the rates a client produces and consumes at. A zero rate is
+// unlimited. A client can use up to a second's worth of a rate at once, and
+// a request that's bigger than that puts the client in debt until the bucket
+// refills. Streams count as one consume request, and then send each record
+// once the client's consumed bytes are back within its rate.
+type Quota struct {
+	ProduceBytesPerSecond    float64
+	ProduceRequestsPerSecond float64
+	ConsumeBytesPerSecond    float64
+	ConsumeRequestsPerSecond float64
+}
+
+// QuotaConfig configures the clients' quotas. Clients are identified by the
+// API key they send in the APIKeyHeader or else by the common name of their
+// TLS certificate's subject. Requests that don't identify a client share the
+// anonymous client's quota.
+type QuotaConfig struct {
+	// APIKeys maps the API keys clients send to their names. If it's set,
+	// requests with an unknown key are refused.
+	APIKeys map[string]string
+	// Default is the quota of clients not in Clients.
+	Default Quota
+	// Clients holds the quotas of particular clients, by name.
+	Clients map[string]Quota
+}
+
+// operation is what a request does, for metering. Requests that write to the
+// server, like registering a schema or snapshotting the log, are metered as
+// produces, and those that read from it, like backups, as consumes.
+type operation string
+
+const (
+	opProduce operation = "produce"
+	opConsume operation = "consume"
+)
+
+var errUnknownAPIKey = errors.New("unknown API key")
+
+// clientKey is the request context key limit stores the client's name under.
+type clientKey struct{}
+
+// requestClient returns the name of the client limit metered the request
+// against.
+func requestClient(r *http.Request) string {
+	client, ok := r.Context().Value(clientKey{}).(string)
+	if !ok {
+		return anonymous
+	}
+	return client
+}
+
+// quotas meters each client's requests and bytes against its quota.
+type quotas struct {
+	config QuotaConfig
+	now    func() time.Time
+
+	mu      sync.Mutex
+	clients map[string]*clientQuota
+}
+
+// clientQuota is a client's token buckets and counters.
+type clientQuota struct {
+	buckets  map[operation]*limits
+	requests map[operation]uint64
+	bytes    map[operation]uint64
+	// throttled counts the requests refused for being over quota
+	throttled map[operation]uint64
+}
+
+// limits is the pair of buckets an operation's limited by.
+type limits struct {
+	requests bucket
+	bytes    bucket
+}
+
+func newQuotas(config *QuotaConfig) *quotas {
+	q := &quotas{now: time.Now, clients: make(map[string]*clientQuota)}
+	if config != nil {
+		q.config = *config
+	}
+	return q
+}
+
+// client returns the name of the client that sent the request.
+func (q *quotas) client(r *http.Request) (string, error) {
+	if key := r.Header.Get(APIKeyHeader); key != "" && len(q.config.APIKeys) > 0 {
+		name, ok := q.config.APIKeys[key]
+		if !ok {
+			return "", errUnknownAPIKey
+		}
+		return name, nil
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		subject := r.TLS.PeerCertificates[0].Subject
+		if subject.CommonName != "" {
+			return subject.CommonName, nil
+		}
+		return subject.String(), nil
+	}
+	return anonymous, nil
+}
+
+// get returns the client's quota state, creating it on its first request.
+// The caller must hold the lock.
+func (q *quotas) get(client string) *clientQuota {
+	c, ok := q.clients[client]
+	if ok {
+		return c
+	}
+	quota, ok := q.config.Clients[client]
+	if !ok {
+		quota = q.config.Default
+	}
+	now := q.now()
+	c = &clientQuota{
+		buckets: map[operation]*limits{
+			opProduce: {
+				requests: newBucket(quota.ProduceRequestsPerSecond, now),
+				bytes:    newBucket(quota.ProduceBytesPerSecond, now),
+			},
+			opConsume: {
+				requests: newBucket(quota.ConsumeRequestsPerSecond, now),
+				bytes:    newBucket(quota.ConsumeBytesPerSecond, now),
+			},
+		},
+		requests:  make(map[operation]uint64),
+		bytes:     make(map[operation]uint64),
+		throttled: make(map[operation]uint64),
+	}
+	q.clients[client] = c
+	return c
+}
+
+// admit takes a request from the client's bucket for the operation. If the
+// client's over quota, it returns how long the client should wait instead.
+func (q *quotas) admit(client string, op operation) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c := q.get(client)
+	b := c.buckets[op]
+	now := q.now()
+	wait := b.requests.wait(now)
+	if w := b.bytes.wait(now); w > wait {
+		wait = w
+	}
+	if wait > 0 {
+		c.throttled[op]++
+		return wait
+	}
+	b.requests.take(1, now)
+	c.requests[op]++
+	return 0
+}
+
+// charge takes the bytes a request produced or consumed from the client's
+// bucket for the operation.
+func (q *quotas) charge(client string, op operation, n int64) {
+	if n <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	c := q.get(client)
+	c.buckets[op].bytes.take(float64(n), q.now())
+	c.bytes[op] += uint64(n)
+}
+
+// wait returns how long until the client's bytes for the operation are back
+// within its quota, zero if they are now. Streams wait this long between
+// records, since they're only admitted once.
+func (q *quotas) wait(client string, op operation) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.get(client).buckets[op].bytes.wait(q.now())
+}
+
+// limit meters the handler's requests as the operation, refusing those of
+// clients over their quota with 429 Too Many Requests and a Retry-After
+// header. Produced bytes are read from the request body and consumed bytes
+// written to the response; handlers that hijack the connection, like the
+// websocket's, charge the messages they send themselves.
+func (s *httpServer) limit(op operation, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client, err := s.quotas.client(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		wait := s.quotas.admit(client, op)
+		if wait > 0 {
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, fmt.Sprintf("%s quota exceeded", op), http.StatusTooManyRequests)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), clientKey{}, client))
+		m := metered{quotas: s.quotas, client: client, op: op}
+		if op == opProduce {
+			r.Body = &meteredBody{ReadCloser: r.Body, metered: m}
+		} else {
+			w = &meteredWriter{ResponseWriter: w, metered: m}
+		}
+		h(w, r)
+	}
+}
+
+// metered charges bytes to a client's quota.
+type metered struct {
+	quotas *quotas
+	client string
+	op     operation
+}
+
+// meteredBody charges the bytes read from a request body.
+type meteredBody struct {
+	io.ReadCloser
+	metered
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.quotas.charge(b.client, b.op, int64(n))
+	return n, err
+}
+
+// meteredWriter charges the bytes written to a response. It passes on
+// flushes for event streams, hijacks for websockets and ReadFrom so that
+// frames are still sent with sendfile.
+type meteredWriter struct {
+	http.ResponseWriter
+	metered
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.quotas.charge(w.client, w.op, int64(n))
+	return n, err
+}
+
+func (w *meteredWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.quotas.charge(w.client, w.op, n)
+	return n, err
+}
+
+func (w *meteredWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *meteredWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response can't be hijacked")
+	}
+	return h.Hijack()
+}
+
+// handleMetrics reports each client's requests, bytes and throttled
+// requests by operation, in the Prometheus text format.
+func (s *httpServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	q := s.quotas
+	q.mu.Lock()
+	names := make([]string, 0, len(q.clients))
+	for name := range q.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	type counter struct {
+		name, help string
+		value      func(c *clientQuota) map[operation]uint64
+	}
+	counters := []counter{
+		{"proglog_client_requests_total", "Requests admitted, by client and operation.",
+			func(c *clientQuota) map[operation]uint64 { return c.requests }},
+		{"proglog_client_bytes_total", "Bytes produced or consumed, by client and operation.",
+			func(c *clientQuota) map[operation]uint64 { return c.bytes }},
+		{"proglog_client_throttled_total", "Requests refused for being over quota, by client and operation.",
+			func(c *clientQuota) map[operation]uint64 { return c.throttled }},
+	}
+	var b []byte
+	for _, ctr := range counters {
+		b = append(b, fmt.Sprintf("# HELP %s %s\n# TYPE %s counter\n", ctr.name, ctr.help, ctr.name)...)
+		for _, name := range names {
+			values := ctr.value(q.clients[name])
+			for _, op := range []operation{opProduce, opConsume} {
+				b = append(b, fmt.Sprintf("%s{client=%q,operation=%q} %d\n",
+					ctr.name, name, op, values[op])...)
+			}
+		}
+	}
+	q.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b)
+}
+
+// bucket is a token bucket that holds up to a second of its rate. Taking
+// more tokens than it holds leaves it in debt.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) bucket {
+	return bucket{rate: rate, tokens: rate, last: now}
+}
+
+// refill adds the tokens accrued since the bucket was last refilled.
+func (b *bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.rate, b.tokens+b.rate*now.Sub(b.last).Seconds())
+		b.last = now
+	}
+}
+
+// wait returns how long until the bucket has a token, zero if it has one now
+// or is unlimited.
+func (b *bucket) wait(now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	need := 1 - b.tokens
+	return time.Duration(need / b.rate * float64(time.Second))
+}
+
+// take removes n tokens from the bucket.
+func (b *bucket) take(n float64, now time.Time) {
+	if b.rate == 0 {
+		return
+	}
+	b.refill(now)
+	b.tokens -= n
+}
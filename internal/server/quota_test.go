@@ -0,0 +1,159 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/internal/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{
+		CommitLog: clog,
+		Quotas: &QuotaConfig{
+			APIKeys: map[string]string{"secret": "team"},
+			Default: Quota{
+				ProduceRequestsPerSecond: 1,
+				ConsumeBytesPerSecond:    10,
+			},
+			Clients: map[string]Quota{"team": {}},
+		},
+	}).Handler)
+	defer srv.Close()
+
+	do := func(method, path, key string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path,
+			strings.NewReader(`{"value":"aGVsbG8gd29ybGQ="}`))
+		require.NoError(t, err)
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// the anonymous client gets a produce a second
+	resp := do("POST", "/records", "")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp = do("POST", "/records", "")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+
+	// a consume bigger than its byte quota is served, leaving the client in
+	// debt for a few seconds
+	resp = do("GET", "/records/0", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do("GET", "/records/0", "")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.NotEqual(t, "1", resp.Header.Get("Retry-After"))
+
+	// backups count as consumes
+	resp = do("GET", "/admin/backup", "")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	// a client with its own quota isn't held up by the anonymous one, and
+	// unknown keys are refused
+	for i := 0; i < 3; i++ {
+		resp = do("POST", "/records", "secret")
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		resp = do("GET", "/records/0", "secret")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+	resp = do("GET", "/admin/backup", "secret")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do("POST", "/records", "wrong")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	metrics := string(b)
+	for _, line := range []string{
+		`proglog_client_requests_total{client="anonymous",operation="produce"} 1`,
+		`proglog_client_throttled_total{client="anonymous",operation="produce"} 1`,
+		`proglog_client_throttled_total{client="anonymous",operation="consume"} 2`,
+		`proglog_client_requests_total{client="team",operation="produce"} 3`,
+		`proglog_client_requests_total{client="team",operation="consume"} 4`,
+		`proglog_client_throttled_total{client="team",operation="consume"} 0`,
+	} {
+		require.Contains(t, metrics, line)
+	}
+}
+
+func TestBucket(t *testing.T) {
+	now := time.Now()
+	b := newBucket(10, now)
+	require.Equal(t, time.Duration(0), b.wait(now))
+	b.take(30, now)
+	require.Equal(t, 2100*time.Millisecond, b.wait(now))
+	// it refills at its rate, up to a second's worth
+	now = now.Add(3 * time.Second)
+	require.Equal(t, time.Duration(0), b.wait(now))
+	now = now.Add(time.Hour)
+	b.refill(now)
+	require.Equal(t, float64(10), b.tokens)
+
+	unlimited := newBucket(0, now)
+	unlimited.take(1000, now)
+	require.Equal(t, time.Duration(0), unlimited.wait(now))
+}
+
+func TestStreamQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stream-quota-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{
+		CommitLog: clog,
+		Quotas: &QuotaConfig{
+			Default: Quota{ConsumeBytesPerSecond: 10},
+		},
+	}).Handler)
+	defer srv.Close()
+	for i := 0; i < 2; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/records/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the first record puts the client in debt for seconds, so the second
+	// waits
+	var record Record
+	require.NoError(t, conn.ReadJSON(&record))
+	require.Equal(t, uint64(0), record.Offset)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	require.Error(t, conn.ReadJSON(&record))
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.NotContains(t, string(b), `proglog_client_bytes_total{client="anonymous",operation="consume"} 0`)
+}
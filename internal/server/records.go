@@ -0,0 +1,272 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/andrwkng/proglog/internal/log"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultRangeMax is how many records GET /records returns when the
+	// request doesn't say.
+	defaultRangeMax = 100
+	// maxRangeMax caps how many records GET /records returns.
+	maxRangeMax = 1000
+)
+
+// RangeResponse is the response to GET /records.
+type RangeResponse struct {
+	Records []Record `json:"records"`
+}
+
+// handleCreateRecord appends the record in the body, encoded as JSON,
+// protobuf or a bare octet-stream value, responding with its offset and its
+// location under /records.
+func (s *httpServer) handleCreateRecord(w http.ResponseWriter, r *http.Request) {
+	s.limitBody(w, r)
+	media, err := contentType(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	record, status, err := decodeRecord(r, media)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	status, err = s.validate(record)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	off, err := s.Log.Append(record)
+	if err != nil {
+		http.Error(w, err.Error(), appendErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaJSON)
+	w.Header().Set("Location", fmt.Sprintf("/records/%d", off))
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(ProduceResponse{Offset: off})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleGetRecord responds with the record at the offset in the URL, encoded
+// as the Accept header prefers. Consumers that pass isolation=read_committed
+// get a 404 for records a read-committed range would leave out.
+func (s *httpServer) handleGetRecord(w http.ResponseWriter, r *http.Request) {
+	off, err := strconv.ParseUint(mux.Vars(r)["offset"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid offset", http.StatusBadRequest)
+		return
+	}
+	isolation, err := isolationParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	media, err := negotiate(r, mediaJSON, mediaProtobuf, mediaOctetStream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	record, err := s.Log.ReadIsolated(off, isolation)
+	if err != nil {
+		http.Error(w, err.Error(), readErrorStatus(err))
+		return
+	}
+
+	err = writeRecord(w, media, record)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleGetRecords responds with up to max records starting at from. It
+// responds with no records once from has passed the end of the log, so
+// consumers can poll for new records with the offset after the last they got.
+// Consumers that pass isolation=read_committed get only records outside
+// transactions or in committed ones.
+// The records are encoded as JSON or, if the Accept header prefers it, as an
+// api.Records protobuf.
+func (s *httpServer) handleGetRecords(w http.ResponseWriter, r *http.Request) {
+	from, max, err := rangeParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	isolation, err := isolationParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	media, err := negotiate(r, mediaJSON, mediaProtobuf)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	records, _, err := s.Log.Scan(from, int(max), isolation)
+	if err != nil {
+		http.Error(w, err.Error(), readErrorStatus(err))
+		return
+	}
+
+	err = writeRecords(w, media, records)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleGetFrames responds with up to max records starting at from, as the
+// frames the log stores them in (see MediaFrames), copied from the store
+// files without decoding them. The records are read uncommitted and include
+// transaction markers, so isolation=read_committed is rejected.
+// NextOffsetHeader holds the offset to continue from.
+// Unless the frames are encrypted, the response has a Content-Length, so
+// they're sent with sendfile rather than chunked.
+func (s *httpServer) handleGetFrames(w http.ResponseWriter, r *http.Request) {
+	from, max, err := rangeParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	isolation, err := isolationParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if isolation == log.ReadCommitted {
+		http.Error(w, "frames can only be read uncommitted", http.StatusBadRequest)
+		return
+	}
+
+	frames, err := s.Log.ReadFrames(from, int(max))
+	if err != nil {
+		http.Error(w, err.Error(), readErrorStatus(err))
+		return
+	}
+	defer frames.Close()
+
+	w.Header().Set("Content-Type", MediaFrames)
+	w.Header().Set(NextOffsetHeader, strconv.FormatUint(frames.NextOffset, 10))
+	if size, ok := frames.Size(); ok {
+		w.Header().Set("Content-Length", strconv.FormatUint(size, 10))
+	}
+	// once the frames start going out, the status can't change, so a failed
+	// copy can only cut the response short
+	frames.WriteTo(w)
+}
+
+// isolationParam parses the isolation query parameter of the requests that
+// read ranges of records.
+func isolationParam(r *http.Request) (log.Isolation, error) {
+	switch v := r.URL.Query().Get("isolation"); v {
+	case "", "read_uncommitted":
+		return log.ReadUncommitted, nil
+	case "read_committed":
+		return log.ReadCommitted, nil
+	default:
+		return 0, fmt.Errorf("invalid isolation %q", v)
+	}
+}
+
+// handleTransaction begins, commits or aborts the transaction in the URL,
+// responding with the offset of the marker it appended.
+func (s *httpServer) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	end := map[string]func(string) (uint64, error){
+		"begin":  s.Log.Begin,
+		"commit": s.Log.Commit,
+		"abort":  s.Log.Abort,
+	}[vars["action"]]
+	off, err := end(vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), appendErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaJSON)
+	err = json.NewEncoder(w).Encode(ProduceResponse{Offset: off})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// rangeParams parses GET /records' from and max query parameters.
+func rangeParams(r *http.Request) (from, max uint64, err error) {
+	q := r.URL.Query()
+	if v := q.Get("from"); v != "" {
+		from, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid from %q", v)
+		}
+	}
+	max = defaultRangeMax
+	if v := q.Get("max"); v != "" {
+		max, err = strconv.ParseUint(v, 10, 64)
+		if err != nil || max == 0 {
+			return 0, 0, fmt.Errorf("invalid max %q", v)
+		}
+	}
+	if max > maxRangeMax {
+		max = maxRangeMax
+	}
+	return from, max, nil
+}
+
+// appendErrorStatus returns the status to respond with when appending failed:
+// 409 if an idempotent producer's sequence number was rejected or the
+// transaction wasn't in the right state, 413 if the record's too large, 503
+// if the log's closed and 500 otherwise.
+func appendErrorStatus(err error) int {
+	for _, conflict := range []error{
+		log.ErrOutOfOrderSequence,
+		log.ErrStaleSequence,
+		log.ErrTransactionOpen,
+		log.ErrTransactionNotOpen,
+	} {
+		if errors.Is(err, conflict) {
+			return http.StatusConflict
+		}
+	}
+	switch {
+	case errors.Is(err, log.ErrRecordTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, log.ErrLogClosed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// readErrorStatus returns the status to respond with when reading failed:
+// 410 if the offset's been truncated from the log, 404 if it hasn't been
+// written yet or isn't committed, 503 if the log's closed and 500 if the record should have been
+// readable, corrupt or not.
+func readErrorStatus(err error) int {
+	var oor *log.OffsetOutOfRangeError
+	switch {
+	case errors.As(err, &oor) && oor.Offset < oor.Lowest:
+		return http.StatusGone
+	case errors.As(err, &oor), errors.Is(err, log.ErrNotCommitted):
+		return http.StatusNotFound
+	case errors.Is(err, log.ErrLogClosed):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "records-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 32
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{CommitLog: clog}).Handler)
+	defer srv.Close()
+
+	// an empty log has nothing at its first offset
+	resp, err := http.Get(srv.URL + "/records/0")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	for i := 0; i < 4; i++ {
+		resp, err := http.Post(srv.URL+"/records", "application/json",
+			strings.NewReader(`{"value":"aGVsbG8gd29ybGQ="}`))
+		require.NoError(t, err)
+		var res ProduceResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		require.Equal(t, uint64(i), res.Offset)
+		require.Equal(t, fmt.Sprintf("/records/%d", i), resp.Header.Get("Location"))
+	}
+
+	resp, err = http.Get(srv.URL + "/records/1")
+	require.NoError(t, err)
+	var record Record
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&record))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.Equal(t, uint64(1), record.Offset)
+
+	resp, err = http.Get(srv.URL + "/records/4")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	for _, tc := range []struct {
+		query string
+		offs  []uint64
+	}{
+		{"from=1&max=2", []uint64{1, 2}},
+		{"from=2", []uint64{2, 3}},
+		{"from=4", []uint64{}},
+	} {
+		resp, err = http.Get(srv.URL + "/records?" + tc.query)
+		require.NoError(t, err)
+		var res RangeResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		resp.Body.Close()
+		offs := []uint64{}
+		for _, r := range res.Records {
+			offs = append(offs, r.Offset)
+		}
+		require.Equal(t, tc.offs, offs, tc.query)
+	}
+
+	resp, err = http.Get(srv.URL + "/records?max=none")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// truncated offsets are gone rather than not found
+	require.NoError(t, clog.Truncate(1))
+	for _, path := range []string{"/records/0", "/records?from=0"} {
+		resp, err = http.Get(srv.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusGone, resp.StatusCode, path)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transactions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{CommitLog: clog}).Handler)
+	defer srv.Close()
+
+	post := func(path, body string) int {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	committed := func() []string {
+		resp, err := http.Get(srv.URL + "/records?isolation=read_committed")
+		require.NoError(t, err)
+		var res RangeResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&res))
+		resp.Body.Close()
+		values := []string{}
+		for _, r := range res.Records {
+			values = append(values, string(r.Value))
+		}
+		return values
+	}
+
+	require.Equal(t, http.StatusOK, post("/transactions/t1/begin", ""))
+	require.Equal(t, http.StatusConflict, post("/transactions/t1/begin", ""))
+	require.Equal(t, http.StatusCreated, post("/records", `{"value":"b25l","transaction_id":"t1"}`))
+	require.Equal(t, http.StatusCreated, post("/records", `{"value":"dHdv","transaction_id":"t1"}`))
+	require.Equal(t, []string{}, committed())
+
+	require.Equal(t, http.StatusOK, post("/transactions/t1/commit", ""))
+	require.Equal(t, http.StatusConflict, post("/transactions/t1/commit", ""))
+	require.Equal(t, http.StatusConflict, post("/records", `{"value":"dGhyZWU=","transaction_id":"t1"}`))
+	require.Equal(t, []string{"one", "two"}, committed())
+
+	// markers are only seen when reading them directly
+	resp, err := http.Get(srv.URL + "/records/0")
+	require.NoError(t, err)
+	var record Record
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&record))
+	resp.Body.Close()
+	require.Equal(t, "begin", record.Marker)
+	require.Equal(t, "t1", record.TransactionID)
+
+	status := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusNotFound, status("/records/0?isolation=read_committed"))
+	require.Equal(t, http.StatusOK, status("/records/1?isolation=read_committed"))
+	require.Equal(t, http.StatusOK, post("/transactions/t2/begin", ""))
+	require.Equal(t, http.StatusCreated, post("/records", `{"value":"Zm91cg==","transaction_id":"t2"}`))
+	require.Equal(t, http.StatusOK, status("/records/5"))
+	require.Equal(t, http.StatusNotFound, status("/records/5?isolation=read_committed"))
+
+	require.Equal(t, http.StatusBadRequest, status("/records?isolation=serializable"))
+	require.Equal(t, http.StatusBadRequest, status("/records/1?isolation=serializable"))
+	require.Equal(t, http.StatusBadRequest, status("/records/frames?isolation=read_committed"))
+}
+
+func TestFrames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frames-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{CommitLog: clog}).Handler)
+	defer srv.Close()
+
+	for i := 0; i < 5; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		offs  []uint64
+		next  string
+	}{
+		{"from=1&max=3", []uint64{1, 2, 3}, "4"},
+		{"from=3", []uint64{3, 4}, "5"},
+		{"from=5", []uint64{}, "5"},
+	} {
+		resp, err := http.Get(srv.URL + "/records/frames?" + tc.query)
+		require.NoError(t, err)
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, tc.query)
+		require.Equal(t, MediaFrames, resp.Header.Get("Content-Type"))
+		require.Equal(t, tc.next, resp.Header.Get(NextOffsetHeader), tc.query)
+		require.Equal(t, int64(len(b)), resp.ContentLength, tc.query)
+
+		offs := []uint64{}
+		for len(b) > 0 {
+			n := binary.BigEndian.Uint64(b[:8])
+			record := &api.Record{}
+			require.NoError(t, proto.Unmarshal(b[8:8+n], record))
+			require.Equal(t, []byte(fmt.Sprintf("record %d", record.Offset)), record.Value)
+			offs = append(offs, record.Offset)
+			b = b[8+n:]
+		}
+		require.Equal(t, tc.offs, offs, tc.query)
+	}
+
+	// a segment holds at most three of the records, so the first is removed
+	require.NoError(t, clog.Truncate(3))
+	resp, err := http.Get(srv.URL + "/records/frames?from=0")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "body-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{
+		CommitLog:      clog,
+		MaxRecordBytes: 16,
+	}).Handler)
+	defer srv.Close()
+
+	value := strings.Repeat("x", 64)
+	for _, tc := range []struct {
+		path, contentType, body string
+	}{
+		{"/records", "application/octet-stream", value},
+		{"/records", "application/json", fmt.Sprintf(`{"value":%q}`, value)},
+		{"/", "application/json", fmt.Sprintf(`{"record":{"value":%q}}`, value)},
+	} {
+		resp, err := http.Post(srv.URL+tc.path, tc.contentType, strings.NewReader(tc.body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, tc.path)
+	}
+
+	resp, err := http.Post(srv.URL+"/records", "application/octet-stream", strings.NewReader("small"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestErrorStatus(t *testing.T) {
+	for err, status := range map[error]int{
+		&log.OffsetOutOfRangeError{Offset: 1, Lowest: 2, Next: 4}:    http.StatusGone,
+		&log.OffsetOutOfRangeError{Offset: 4, Lowest: 2, Next: 4}:    http.StatusNotFound,
+		&log.CorruptRecordError{Offset: 2, Err: io.ErrUnexpectedEOF}: http.StatusInternalServerError,
+		log.ErrLogClosed: http.StatusServiceUnavailable,
+	} {
+		require.Equal(t, status, readErrorStatus(fmt.Errorf("read: %w", err)), "%v", err)
+	}
+	for err, status := range map[error]int{
+		&log.RecordTooLargeError{Size: 2048, Max: 1024}: http.StatusRequestEntityTooLarge,
+		log.ErrOutOfOrderSequence:                       http.StatusConflict,
+		log.ErrLogClosed:                                http.StatusServiceUnavailable,
+		errors.New("disk full"):                         http.StatusInternalServerError,
+	} {
+		require.Equal(t, status, appendErrorStatus(err), "%v", err)
+	}
+}
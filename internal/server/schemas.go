@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/internal/schema"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// TopicHeader is the record header naming the topic, and so the schema
+	// subject, the record belongs to.
+	TopicHeader = "topic"
+	// DefaultTopic is the topic of records that don't name one.
+	DefaultTopic = "records"
+	// SchemaIDHeader is the record header holding the ID of the schema the
+	// record's value matched. Producers may set it to validate against an
+	// older version of the topic's schema than the latest.
+	SchemaIDHeader = "schema-id"
+)
+
+// validate checks the record's value against its topic's schema, if it has
+// one, and stamps the record with the ID of the schema it matched. It returns
+// the status to respond with if the record's rejected.
+func (s *httpServer) validate(record *api.Record) (int, error) {
+	if s.schemas == nil {
+		return 0, nil
+	}
+	topic := record.Headers[TopicHeader]
+	if topic == "" {
+		topic = DefaultTopic
+	}
+	var id *uint64
+	if v, ok := record.Headers[SchemaIDHeader]; ok {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return http.StatusBadRequest, fmt.Errorf("invalid %s header %q", SchemaIDHeader, v)
+		}
+		id = &n
+	}
+
+	matched, err := s.schemas.Validate(topic, id, record.Value)
+	if errors.Is(err, schema.ErrNotFound) && id == nil {
+		// topics without a schema take any value
+		return 0, nil
+	}
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	if record.Headers == nil {
+		record.Headers = make(map[string]string)
+	}
+	record.Headers[SchemaIDHeader] = strconv.FormatUint(matched, 10)
+	return 0, nil
+}
+
+// handleRegisterSchema registers the schema in the body as the subject's next
+// version.
+func (s *httpServer) handleRegisterSchema(w http.ResponseWriter, r *http.Request) {
+	if s.schemas == nil {
+		http.Error(w, "schema registry is disabled", http.StatusNotFound)
+		return
+	}
+	var req schema.Schema
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Subject = mux.Vars(r)["subject"]
+
+	res, err := s.schemas.Register(req)
+	if err != nil {
+		http.Error(w, err.Error(), schemaErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", mediaJSON)
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleGetSchemaVersions responds with the subject's schemas, oldest first.
+func (s *httpServer) handleGetSchemaVersions(w http.ResponseWriter, r *http.Request) {
+	if s.schemas == nil {
+		http.Error(w, "schema registry is disabled", http.StatusNotFound)
+		return
+	}
+	versions := s.schemas.Versions(mux.Vars(r)["subject"])
+	if len(versions) == 0 {
+		http.Error(w, schema.ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", mediaJSON)
+	err := json.NewEncoder(w).Encode(versions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleGetSchemaVersion responds with the subject's schema with the version
+// in the URL, which may be latest.
+func (s *httpServer) handleGetSchemaVersion(w http.ResponseWriter, r *http.Request) {
+	if s.schemas == nil {
+		http.Error(w, "schema registry is disabled", http.StatusNotFound)
+		return
+	}
+	vars := mux.Vars(r)
+	version := 0
+	if vars["version"] != "latest" {
+		var err error
+		version, err = strconv.Atoi(vars["version"])
+		if err != nil || version == 0 {
+			http.Error(w, "invalid version", http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := s.schemas.Version(vars["subject"], version)
+	if err != nil {
+		http.Error(w, err.Error(), schemaErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", mediaJSON)
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleGetSchema responds with the schema with the ID in the URL.
+func (s *httpServer) handleGetSchema(w http.ResponseWriter, r *http.Request) {
+	if s.schemas == nil {
+		http.Error(w, "schema registry is disabled", http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	res, err := s.schemas.Get(id)
+	if err != nil {
+		http.Error(w, err.Error(), schemaErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", mediaJSON)
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// schemaErrorStatus returns the status to respond with when a registry call
+// failed.
+func schemaErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, schema.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, schema.ErrIncompatible):
+		return http.StatusConflict
+	case errors.Is(err, schema.ErrInvalidSchema):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andrwkng/proglog/internal/log"
+	"github.com/andrwkng/proglog/internal/schema"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "schemas-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "log"), 0755))
+	clog, err := log.NewLog(filepath.Join(dir, "log"), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	schemas, err := schema.NewRegistry(filepath.Join(dir, "schemas"), schema.Config{})
+	require.NoError(t, err)
+	defer schemas.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{
+		CommitLog: clog,
+		Schemas:   schemas,
+	}).Handler)
+	defer srv.Close()
+
+	post := func(path, body string) *http.Response {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := post("/subjects/records/versions", `{
+		"type": "JSON",
+		"schema": "{\"type\": \"object\", \"required\": [\"name\"]}"
+	}`)
+	var registered schema.Schema
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&registered))
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "records", registered.Subject)
+	require.Equal(t, 1, registered.Version)
+
+	resp = post("/subjects/records/versions", `{
+		"type": "JSON",
+		"schema": "{\"type\": \"object\", \"required\": [\"name\", \"age\"]}"
+	}`)
+	resp.Body.Close()
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "/subjects/records/versions/latest")
+	require.NoError(t, err)
+	var latest schema.Schema
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&latest))
+	resp.Body.Close()
+	require.Equal(t, registered, latest)
+
+	// {"age": 36} is missing its name
+	resp = post("/records", `{"value": "eyJhZ2UiOiAzNn0="}`)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	// {"name": "ada"} matches and is stamped with the schema's ID
+	resp = post("/records", `{"value": "eyJuYW1lIjogImFkYSJ9"}`)
+	var produced ProduceResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&produced))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Get(fmt.Sprintf("%s/records/%d", srv.URL, produced.Offset))
+	require.NoError(t, err)
+	var record Record
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&record))
+	resp.Body.Close()
+	require.Equal(t, fmt.Sprint(registered.ID), record.Headers[SchemaIDHeader])
+
+	// topics without a schema take anything
+	resp = post("/records", `{"value": "bm90IGpzb24=", "headers": {"topic": "logs"}}`)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+}
@@ -0,0 +1,271 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrwkng/proglog/internal/log"
+	"github.com/gorilla/websocket"
+)
+
+// keepAliveInterval is how often an idle stream sends something to keep
+// proxies from closing the connection.
+const keepAliveInterval = 15 * time.Second
+
+// errGone is returned by follow when the next offset has been truncated.
+var errGone = errors.New("offset truncated")
+
+// streamStart returns the offset a stream starts at: the offset after the
+// Last-Event-ID a reconnecting client resumes from, otherwise the from query
+// parameter, otherwise the start of the log.
+func streamStart(r *http.Request) (uint64, error) {
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		off, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Last-Event-ID %q", id)
+		}
+		return off + 1, nil
+	}
+	if v := r.URL.Query().Get("from"); v != "" {
+		off, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid from %q", v)
+		}
+		return off, nil
+	}
+	return 0, nil
+}
+
+// closeStreams ends the streams being served and any started after.
+func (s *httpServer) closeStreams() {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+	})
+}
+
+// follow calls send with each record from off on that's visible at the
+// isolation level, waiting for new records once it has caught up and calling
+// keepAlive if it waits for long. Read-committed streams wait at the last
+// stable offset until the transaction holding it back ends. Before each
+// record, it waits for the client to be within its consume byte quota. It
+// returns when ctx is done, the server shuts down or a call fails.
+func (s *httpServer) follow(
+	ctx context.Context,
+	client string,
+	off uint64,
+	isolation log.Isolation,
+	send func(Record) error,
+	keepAlive func() error,
+) error {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	throttle := func() error {
+		for {
+			wait := s.quotas.wait(client, opConsume)
+			if wait <= 0 {
+				return nil
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-s.shutdown:
+				timer.Stop()
+				return http.ErrServerClosed
+			case <-ticker.C:
+				timer.Stop()
+				err := keepAlive()
+				if err != nil {
+					return err
+				}
+			case <-timer.C:
+			}
+		}
+	}
+	for {
+		// get the channel before scanning so we can't miss an append made
+		// between the scan catching up and us waiting
+		appended := s.Log.Appended()
+		records, next, err := s.Log.Scan(off, defaultRangeMax, isolation)
+		if err != nil {
+			if readErrorStatus(err) == http.StatusGone {
+				return errGone
+			}
+			return err
+		}
+		for _, record := range records {
+			err = throttle()
+			if err != nil {
+				return err
+			}
+			err = send(newRecord(record))
+			if err != nil {
+				return err
+			}
+		}
+		if next > off {
+			off = next
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.shutdown:
+			return http.ErrServerClosed
+		case <-appended:
+		case <-ticker.C:
+			err = keepAlive()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handleEvents streams records as Server-Sent Events, each with the record's
+// offset as its ID so that a reconnecting EventSource resumes after the last
+// record it got. Like GET /records, it leaves out transaction markers and
+// takes an isolation query parameter.
+func (s *httpServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	off, err := streamStart(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	isolation, err := isolationParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if off < s.lowestOffset() {
+		http.Error(w, errGone.Error(), http.StatusGone)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err = s.follow(r.Context(), requestClient(r), off, isolation, func(record Record) error {
+		b, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: record\ndata: %s\n\n", record.Offset, b)
+		flusher.Flush()
+		return err
+	}, func() error {
+		_, err := fmt.Fprint(w, ": keep-alive\n\n")
+		flusher.Flush()
+		return err
+	})
+	if err == errGone {
+		// the stream fell behind truncation, tell the client it can't resume
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+		flusher.Flush()
+	}
+}
+
+// checkOrigin allows WebSocket upgrades from pages served by the server
+// itself, from the allowed origins, and from clients that aren't browsers and
+// so don't send an Origin header.
+func (s *httpServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.allowedOrigins {
+		if strings.EqualFold(origin, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWebSocket streams records as JSON text messages over a WebSocket,
+// reading them the way handleEvents does.
+func (s *httpServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	off, err := streamStart(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	isolation, err := isolationParam(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if off < s.lowestOffset() {
+		http.Error(w, errGone.Error(), http.StatusGone)
+		return
+	}
+	upgrader := websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already responded
+		return
+	}
+	defer conn.Close()
+
+	// read, and discard, messages so control frames get handled and we learn
+	// when the client goes away
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			_, _, err := conn.NextReader()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// the connection's hijacked, so the messages aren't metered by limit
+	client := requestClient(r)
+	err = s.follow(ctx, client, off, isolation, func(record Record) error {
+		b, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		err = conn.WriteMessage(websocket.TextMessage, b)
+		s.quotas.charge(client, opConsume, int64(len(b)))
+		return err
+	}, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+	})
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	if err == errGone {
+		msg = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())
+	}
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
+
+// lowestOffset returns the log's lowest offset, or 0 if it can't be read, in
+// which case reading will fail with the reason.
+func (s *httpServer) lowestOffset() uint64 {
+	off, err := s.Log.LowestOffset()
+	if err != nil {
+		return 0
+	}
+	return off
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	api "github.com/andrwkng/proglog/api/v1"
+	"github.com/andrwkng/proglog/internal/log"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, clog *log.Log, url string,
+	){
+		"events resume after last event id": testEvents,
+		"websocket follows appends":         testWebSocket,
+		"read committed stream":             testCommittedStream,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "stream-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 32
+			clog, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+			defer clog.Close()
+			srv := httptest.NewServer(NewHTTPServer("", &Config{CommitLog: clog}).Handler)
+			defer srv.Close()
+			for i := 0; i < 3; i++ {
+				_, err := clog.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			fn(t, clog, srv.URL)
+		})
+	}
+}
+
+func testEvents(t *testing.T, clog *log.Log, url string) {
+	req, err := http.NewRequest(http.MethodGet, url+"/records/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := bufio.NewReader(resp.Body)
+	next := func() (id string, record Record) {
+		for {
+			line, err := events.ReadString('\n')
+			require.NoError(t, err)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && id != "":
+				return id, record
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &record)
+				require.NoError(t, err)
+			}
+		}
+	}
+
+	for _, want := range []string{"1", "2"} {
+		id, record := next()
+		require.Equal(t, want, id)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+
+	// the stream waits for the next append
+	off, err := clog.Append(&api.Record{Value: []byte("goodbye")})
+	require.NoError(t, err)
+	id, record := next()
+	require.Equal(t, "3", id)
+	require.Equal(t, off, record.Offset)
+	require.Equal(t, []byte("goodbye"), record.Value)
+}
+
+func testWebSocket(t *testing.T, clog *log.Log, url string) {
+	url = "ws" + strings.TrimPrefix(url, "http") + "/records/ws?from=2"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var record Record
+	require.NoError(t, conn.ReadJSON(&record))
+	require.Equal(t, uint64(2), record.Offset)
+
+	off, err := clog.Append(&api.Record{Value: []byte("goodbye")})
+	require.NoError(t, err)
+	require.NoError(t, conn.ReadJSON(&record))
+	require.Equal(t, off, record.Offset)
+	require.Equal(t, []byte("goodbye"), record.Value)
+}
+
+func testCommittedStream(t *testing.T, clog *log.Log, url string) {
+	_, err := clog.Begin("t1")
+	require.NoError(t, err)
+	_, err = clog.Append(&api.Record{Value: []byte("in txn"), TransactionId: "t1"})
+	require.NoError(t, err)
+
+	url = "ws" + strings.TrimPrefix(url, "http") + "/records/ws?from=2&isolation=read_committed"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var record Record
+	require.NoError(t, conn.ReadJSON(&record))
+	require.Equal(t, uint64(2), record.Offset)
+
+	// the stream waits at the open transaction until it's committed, and
+	// leaves out its markers
+	_, err = clog.Append(&api.Record{Value: []byte("after txn")})
+	require.NoError(t, err)
+	_, err = clog.Commit("t1")
+	require.NoError(t, err)
+	for _, want := range []string{"in txn", "after txn"} {
+		require.NoError(t, conn.ReadJSON(&record))
+		require.Equal(t, []byte(want), record.Value)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stream-origin-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{
+		CommitLog:      clog,
+		AllowedOrigins: []string{"https://dashboard.example.com"},
+	}).Handler)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/records/ws"
+
+	for origin, allowed := range map[string]bool{
+		"":                              true,
+		srv.URL:                         true,
+		"https://dashboard.example.com": true,
+		"https://evil.example.com":      false,
+	} {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if allowed {
+			require.NoError(t, err, origin)
+			conn.Close()
+			continue
+		}
+		require.Equal(t, websocket.ErrBadHandshake, err, origin)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode, origin)
+	}
+}